@@ -6,10 +6,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"cursor2api/internal/client"
 	"cursor2api/internal/config"
 	"cursor2api/internal/handler"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/middleware"
+	"cursor2api/internal/modelmap"
 	"cursor2api/internal/token"
 
 	"github.com/gin-gonic/gin"
@@ -20,40 +31,69 @@ var log = logger.Get().WithPrefix("Main")
 func main() {
 	// 加载配置
 	cfg := config.Get()
+	if err := cfg.Upstream.Validate(); err != nil {
+		log.Error("配置错误: %v", err)
+		os.Exit(1)
+	}
 
 	// 初始化 Token Pool（预热 token，确保启动时就准备好）
 	log.Info("正在初始化 Token Pool...")
 	token.GetPool()
 
+	// 加载模型映射
+	modelmap.Get()
+
 	// 初始化 HTTP 客户端服务
 	log.Info("正在初始化客户端服务...")
 	client.GetService()
 
 	// 创建 Gin 引擎
 	r := gin.Default()
+	r.Use(middleware.RequestID())
+	r.Use(middleware.BodyLimit())
 
 	// ==================== 路由配置 ====================
 
+	// API 接口（配置 api_keys 后需要鉴权）
+	api := r.Group("", middleware.Auth())
+
+	// 会请求 Cursor 的接口受并发限制
+	limit := middleware.ConcurrencyLimit()
+	// Idempotency-Key：重复提交直接返回缓存的响应，不占用并发名额
+	idem := middleware.Idempotency()
+	// 按客户端限制请求数和 token 用量（重复提交的缓存响应不计入）
+	rate := middleware.RateLimit()
+
 	// OpenAI 兼容接口
-	r.GET("/v1/models", handler.ListModels)
-	r.POST("/v1/chat/completions", handler.ChatCompletions)
-
-	// Anthropic Messages API 兼容接口
-	r.POST("/v1/messages", handler.Messages)
-	r.POST("/messages", handler.Messages)
-	r.POST("/v1/messages/count_tokens", handler.CountTokens)
-	r.POST("/messages/count_tokens", handler.CountTokens)
-
-	// 健康检查
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	api.GET("/v1/models", handler.ListModels)
+	api.GET("/v1/models/:model", handler.GetModel)
+	api.POST("/v1/chat/completions", idem, rate, limit, handler.ChatCompletions)
+
+	// Anthropic Messages API 兼容接口（校验 anthropic-version）
+	anthropic := api.Group("", middleware.AnthropicVersion())
+	anthropic.POST("/v1/messages", idem, rate, limit, handler.Messages)
+	anthropic.POST("/messages", idem, rate, limit, handler.Messages)
+	anthropic.POST("/v1/messages/count_tokens", handler.CountTokens)
+	anthropic.POST("/messages/count_tokens", handler.CountTokens)
+
+	// 调试接口：返回转换后的 Cursor 请求，不请求上游
+	if config.Get().DebugEndpoints {
+		log.Warn("已开启调试接口 /debug/convert")
+		api.POST("/debug/convert", handler.DebugConvert)
+	}
+
+	// 健康检查（存活 / 就绪探针）
+	r.GET("/health", handler.Health)
+	r.GET("/ready", handler.Ready)
+
+	// Prometheus 指标
+	r.GET("/metrics", metrics.Handler())
 
 	// 客户端状态
 	r.GET("/status", func(c *gin.Context) {
 		svc := client.GetService()
 		hasToken := svc.GetXIsHuman() != ""
-		c.JSON(200, gin.H{"hasToken": hasToken})
+		c.JSON(200, gin.H{"hasToken": hasToken, "sessionPool": svc.PoolStats(), "accounts": svc.AccountStats()})
 	})
 
 	// 静态文件
@@ -62,9 +102,53 @@ func main() {
 		c.File("./static/index.html")
 	})
 
-	// 启动服务
-	log.Info("服务运行在端口 %s", cfg.Port)
-	if err := r.Run(":" + cfg.Port); err != nil {
-		log.Error("启动失败: %v", err)
+	// 启动服务（监听失败时经 serveErr 通知主协程退出）
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: r}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Info("服务运行在端口 %s", cfg.Port)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	// 优雅关闭
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("启动失败: %v", err)
+			os.Exit(1)
+		}
+		return
+	case <-ctx.Done():
+	}
+	stop()
+	shutdown(srv, time.Duration(cfg.ShutdownGrace)*time.Second)
+}
+
+// drainTimeout 宽限期结束、中止上游请求后，等待各流写完结束事件的时间
+const drainTimeout = 5 * time.Second
+
+// shutdown 停止接受新连接并等待进行中的请求完成
+// 超过宽限期时中止剩余请求的上游读取，让流以已生成的内容正常结束
+func shutdown(srv *http.Server, grace time.Duration) {
+	log.Info("收到退出信号，等待进行中的请求完成（宽限期 %v）...", grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		log.Info("服务已关闭")
+		return
+	}
+
+	log.Warn("宽限期已到，提前结束进行中的请求")
+	handler.Drain()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer drainCancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Error("仍有连接未关闭，强制关闭: %v", err)
+		_ = srv.Close()
+		return
 	}
+	log.Info("服务已关闭")
 }
@@ -0,0 +1,222 @@
+// Package client 提供 Cursor API 客户端实现
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/metrics"
+
+	"github.com/enetx/surf"
+)
+
+// defaultAccountName 未配置 accounts 时默认账号的名称
+const defaultAccountName = "default"
+
+// account 单个上游账号：独立的会话池（可走独立代理）和附加请求头
+type account struct {
+	name     string
+	headers  map[string]string
+	sessions *sessionPool
+
+	// 以下字段由 accountPool.mu 保护
+	failures       int       // 连续限流/鉴权失败次数，成功后清零
+	unhealthyUntil time.Time // 冷却结束时间，之前不参与选择
+	lastUsed       time.Time
+}
+
+// accountPool 上游账号池：按策略为每个请求选择账号，连续限流/鉴权失败的账号冷却一段时间
+type accountPool struct {
+	mu        sync.Mutex
+	accounts  []*account
+	lru       bool
+	threshold int
+	cooldown  time.Duration
+	next      int // 轮询起点
+}
+
+// AccountStats 单个上游账号的状态
+type AccountStats struct {
+	Name     string     `json:"name"`
+	Healthy  bool       `json:"healthy"`
+	Failures int        `json:"consecutive_failures"`
+	Cooldown *time.Time `json:"cooldown_until,omitempty"`
+	Pool     PoolStats  `json:"session_pool"`
+}
+
+// newAccountPool 按配置创建账号池，未配置 accounts 时只有一个直连的默认账号
+func newAccountPool(cfg *config.Config) *accountPool {
+	accounts := cfg.Accounts
+	if len(accounts) == 0 {
+		accounts = []config.AccountConfig{{Name: defaultAccountName}}
+	}
+
+	p := &accountPool{
+		lru:       cfg.AccountSelection == "lru",
+		threshold: cfg.AccountHealth.FailureThreshold,
+		cooldown:  time.Duration(cfg.AccountHealth.CooldownSeconds) * time.Second,
+	}
+	waitTimeout := time.Duration(cfg.SessionPool.WaitTimeoutMs) * time.Millisecond
+	for i, ac := range accounts {
+		name := ac.Name
+		if name == "" {
+			name = fmt.Sprintf("account-%d", i+1)
+		}
+		proxy := ac.Proxy
+		a := &account{
+			name:    name,
+			headers: ac.Headers,
+			sessions: newSessionPool(cfg.SessionPool.Size, waitTimeout, func() *surf.Client {
+				builder := surf.NewClient().Builder().Impersonate().Chrome()
+				if proxy != "" {
+					builder = builder.Proxy(proxy)
+				}
+				return builder.Build()
+			}),
+		}
+		p.accounts = append(p.accounts, a)
+		metrics.AccountHealthy(a.name, true)
+	}
+	return p
+}
+
+// pick 选择一个账号，跳过 exclude 中（本次请求已失败）的账号
+// 优先选择可用账号；全部在冷却中时选择最早结束冷却的账号，不直接拒绝请求
+// 没有可选账号时返回 nil；healthy 表示选中的账号不在冷却中
+func (p *accountPool) pick(exclude map[*account]bool) (a *account, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var fallback *account
+	n := len(p.accounts)
+	for i := 0; i < n; i++ {
+		candidate := p.accounts[(p.next+i)%n]
+		if exclude[candidate] {
+			continue
+		}
+		if now.Before(candidate.unhealthyUntil) {
+			if fallback == nil || candidate.unhealthyUntil.Before(fallback.unhealthyUntil) {
+				fallback = candidate
+			}
+			continue
+		}
+		if !p.lru {
+			// 轮询：选中第一个可用账号，下次从它之后开始
+			a = candidate
+			p.next = (p.next + i + 1) % n
+			break
+		}
+		if a == nil || candidate.lastUsed.Before(a.lastUsed) {
+			a = candidate
+		}
+	}
+
+	healthy = a != nil
+	if a == nil {
+		a = fallback
+	}
+	if a != nil {
+		a.lastUsed = now
+	}
+	return a, healthy
+}
+
+// report 记录一次请求结果：成功时清零连续失败次数；
+// 限流/鉴权失败累计达到阈值时标记冷却，冷却结束后重新参与选择（再次失败立即重新冷却）
+func (p *accountPool) report(a *account, err error) {
+	status, ok := accountFailure(err)
+	if err != nil && !ok {
+		// 网络错误、5xx、客户端中止等与账号无关
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !ok {
+		a.failures = 0
+		return
+	}
+
+	metrics.AccountFailure(a.name, status)
+	a.failures++
+	if p.threshold <= 0 || a.failures < p.threshold || p.cooldown <= 0 {
+		return
+	}
+	until := time.Now().Add(p.cooldown)
+	a.unhealthyUntil = until
+	metrics.AccountHealthy(a.name, false)
+	log.Warn("账号 %s 连续 %d 次被限流或鉴权失败（HTTP %d），暂停使用 %v", a.name, a.failures, status, p.cooldown)
+
+	time.AfterFunc(p.cooldown, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// 冷却期间再次被标记时由后一个定时器恢复
+		if a.unhealthyUntil.Equal(until) {
+			metrics.AccountHealthy(a.name, true)
+			log.Info("账号 %s 冷却结束，恢复使用", a.name)
+		}
+	})
+}
+
+// stats 返回各账号状态
+func (p *accountPool) stats() []AccountStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]AccountStats, len(p.accounts))
+	for i, a := range p.accounts {
+		stats[i] = AccountStats{
+			Name:     a.name,
+			Healthy:  !now.Before(a.unhealthyUntil),
+			Failures: a.failures,
+			Pool:     a.sessions.stats(),
+		}
+		if !stats[i].Healthy {
+			until := a.unhealthyUntil
+			stats[i].Cooldown = &until
+		}
+	}
+	return stats
+}
+
+// poolStats 汇总所有账号的会话池使用情况
+func (p *accountPool) poolStats() PoolStats {
+	var total PoolStats
+	for _, a := range p.accounts {
+		s := a.sessions.stats()
+		total.Size += s.Size
+		total.InUse += s.InUse
+		total.Acquired += s.Acquired
+		total.Waited += s.Waited
+		total.Timeouts += s.Timeouts
+	}
+	return total
+}
+
+// sessionCount 所有账号的会话总数
+func (p *accountPool) sessionCount() int {
+	n := 0
+	for _, a := range p.accounts {
+		n += a.sessions.size
+	}
+	return n
+}
+
+// accountFailure 判断错误是否归因于账号本身（429 限流、401/403 鉴权失败），返回状态码
+func accountFailure(err error) (int, bool) {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return 0, false
+	}
+	switch statusErr.StatusCode {
+	case 429, 401, 403:
+		return statusErr.StatusCode, true
+	}
+	return 0, false
+}
@@ -3,21 +3,26 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
 	"cursor2api/internal/token"
 
 	"github.com/enetx/g"
-	"github.com/enetx/surf"
 )
 
 var log = logger.Get().WithPrefix("Client")
 
-// Cursor API 端点
-const cursorChatAPI = "https://cursor.com/api/chat"
+// cursorChatPath Cursor 聊天接口路径（拼接在上游基础地址之后）
+const cursorChatPath = "/api/chat"
 
 // Chrome 浏览器请求头模拟
 var chromeChatHeaders = map[string]string{
@@ -39,10 +44,15 @@ var chromeChatHeaders = map[string]string{
 	"priority":                   "u=1, i",
 }
 
+// ErrStopStream 由流式回调返回，通知客户端停止读取上游响应（如客户端已断开、已命中停止序列）
+var ErrStopStream = errors.New("stop stream")
+
 // Service HTTP 客户端服务
 type Service struct {
-	surfClient *surf.Client
-	cfg        *config.Config
+	accounts *accountPool
+	cfg      *config.Config
+	retry    RetryPolicy
+	routes   upstreamRoutes
 }
 
 var (
@@ -50,26 +60,63 @@ var (
 	once     sync.Once
 )
 
-// GetService 获取服务单例
+// GetService 获取服务单例（重试参数来自配置）
 func GetService() *Service {
 	once.Do(func() {
-		instance = &Service{
-			cfg: config.Get(),
-		}
-		instance.init()
+		cfg := config.Get()
+		instance = NewService(cfg, RetryPolicy{
+			MaxAttempts: cfg.Retry.MaxAttempts,
+			BaseDelay:   time.Duration(cfg.Retry.BaseDelayMs) * time.Millisecond,
+			MaxDelay:    time.Duration(cfg.Retry.MaxDelayMs) * time.Millisecond,
+		})
 	})
 	return instance
 }
 
+// NewService 创建服务实例
+func NewService(cfg *config.Config, retry RetryPolicy) *Service {
+	s := &Service{
+		cfg:    cfg,
+		retry:  retry,
+		routes: newUpstreamRoutes(cfg.Upstream),
+	}
+	s.init()
+	return s
+}
+
 // init 初始化 HTTP 客户端
 func (s *Service) init() {
-	s.surfClient = surf.NewClient().
-		Builder().
-		Impersonate().
-		Chrome().
-		Build()
+	s.accounts = newAccountPool(s.cfg)
 
-	log.Info("客户端初始化完成")
+	log.Info("客户端初始化完成, 账号数: %d, 会话数: %d", len(s.accounts.accounts), s.accounts.sessionCount())
+}
+
+// Ping 检查上游连通性：选择一个账号取得会话并向上游基础地址发送 HEAD 请求
+// 只要收到 HTTP 响应（无论状态码）即视为可达
+func (s *Service) Ping(ctx context.Context) error {
+	acct, _ := s.accounts.pick(nil)
+	sess, err := acct.sessions.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer acct.sessions.release(sess)
+
+	resp := sess.Head(g.String(s.routes.baseURL)).WithContext(ctx).Do()
+	if resp.IsErr() {
+		return fmt.Errorf("Cursor 不可达: %w", resp.Err())
+	}
+	_ = resp.Ok().Body.Close()
+	return nil
+}
+
+// PoolStats 返回会话池使用情况（所有账号汇总）
+func (s *Service) PoolStats() PoolStats {
+	return s.accounts.poolStats()
+}
+
+// AccountStats 返回各上游账号的健康状态和会话池使用情况
+func (s *Service) AccountStats() []AccountStats {
+	return s.accounts.stats()
 }
 
 // GetXIsHuman 获取当前 token（兼容旧接口）
@@ -94,6 +141,12 @@ type CursorChatRequest struct {
 	ID       string          `json:"id"`
 	Messages []CursorMessage `json:"messages"`
 	Trigger  string          `json:"trigger"`
+	// MaxTokens 最大输出 token 数（未设置时不发送）
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// 采样参数（未设置时不发送）
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
 }
 
 // CursorContext 上下文信息
@@ -110,67 +163,182 @@ type CursorMessage struct {
 	Role  string       `json:"role"`
 }
 
-// CursorPart 消息内容
+// CursorPart 消息内容，每个内容块对应一个 part
 type CursorPart struct {
 	Type string `json:"type"`
 	Text string `json:"text"`
+	// CacheControl 客户端在内容块上标记的缓存提示
+	// Cursor 目前不支持提示词缓存，因此不发送；保留块边界和标记，便于以后接入缓存
+	CacheControl *CacheControl `json:"-"`
+}
+
+// CacheControl Anthropic 的 cache_control 标记
+type CacheControl struct {
+	Type string `json:"type"`
 }
 
 // SendRequest 发送非流式请求
-func (s *Service) SendRequest(req CursorChatRequest) (string, error) {
-	return s.SendRequestWithIP(req, "")
+func (s *Service) SendRequest(ctx context.Context, req CursorChatRequest) (string, error) {
+	return s.SendRequestWithIP(ctx, req, "")
 }
 
 // SendRequestWithIP 发送非流式请求（带客户端 IP）
-func (s *Service) SendRequestWithIP(req CursorChatRequest, clientIP string) (string, error) {
-	return s.doRequest(req, nil, clientIP)
+// ctx 取消或超时时返回已收到的部分响应和错误
+func (s *Service) SendRequestWithIP(ctx context.Context, req CursorChatRequest, clientIP string) (string, error) {
+	return s.doRequest(ctx, req, nil, clientIP)
 }
 
 // SendStreamRequest 发送流式请求
-func (s *Service) SendStreamRequest(req CursorChatRequest, onChunk func(chunk string)) error {
-	return s.SendStreamRequestWithIP(req, onChunk, "")
+func (s *Service) SendStreamRequest(ctx context.Context, req CursorChatRequest, onEvents func(events []CursorEvent) error) error {
+	return s.SendStreamRequestWithIP(ctx, req, onEvents, "")
 }
 
 // SendStreamRequestWithIP 发送流式请求（带客户端 IP）
-func (s *Service) SendStreamRequestWithIP(req CursorChatRequest, onChunk func(chunk string), clientIP string) error {
-	_, err := s.doRequest(req, onChunk, clientIP)
-	return err
+// 响应按 SSE 行切分并解析为事件，每读到一批完整的事件回调一次 onEvents；跨数据块的行（含被拆开的多字节字符）拼完整后再解析
+// ctx 取消或超时时中止上游请求；onEvents 返回 ErrStopStream 时停止读取并正常返回，返回其他错误时中止并返回该错误
+// 上游发送了 error 事件，或整个响应都不是 SSE（JSON 错误、HTML 错误页等）时返回错误
+func (s *Service) SendStreamRequestWithIP(ctx context.Context, req CursorChatRequest, onEvents func(events []CursorEvent) error, clientIP string) error {
+	var decoder eventDecoder
+	stopped := false
+	deliver := func(events []CursorEvent) error {
+		if len(events) == 0 || stopped {
+			return nil
+		}
+		err := onEvents(events)
+		stopped = errors.Is(err, ErrStopStream)
+		return err
+	}
+	_, err := s.doRequest(ctx, req, func(chunk string) error {
+		return deliver(decoder.Feed(chunk))
+	}, clientIP)
+	if err != nil {
+		return err
+	}
+	// 流结束时残留的最后一行
+	if err := deliver(decoder.Flush()); err != nil && !stopped {
+		return err
+	}
+	return decoder.Err()
+}
+
+// doRequest 发送 API 请求，网络错误和 5xx 按重试策略重试
+// 账号被限流或鉴权失败时立即切换到其他可用账号（不计入重试次数）
+// 流式请求一旦已回调过数据就不再重试（已下发的内容无法重放）
+func (s *Service) doRequest(ctx context.Context, req CursorChatRequest, onChunk func(chunk string) error, clientIP string) (string, error) {
+	failed := make(map[*account]bool)
+	for attempt := 1; ; attempt++ {
+		acct, _ := s.accounts.pick(failed)
+		if acct == nil {
+			// 所有账号都已失败过：重新在全部账号中选择
+			clear(failed)
+			acct, _ = s.accounts.pick(nil)
+		}
+		body, delivered, err := s.doAttempt(ctx, acct, req, onChunk, clientIP)
+		if ctx.Err() == nil {
+			s.accounts.report(acct, err)
+		}
+		if _, ok := accountFailure(err); ok && ctx.Err() == nil && delivered == 0 {
+			failed[acct] = true
+			if next, healthy := s.accounts.pick(failed); next != nil && healthy {
+				log.Warn("账号 %s 请求失败，切换到账号 %s: %v", acct.name, next.name, err)
+				attempt--
+				continue
+			}
+		}
+		if err == nil || ctx.Err() != nil || delivered > 0 || !retryable(err) || attempt >= s.retry.MaxAttempts {
+			// 客户端断开、超时等主动中止不计为上游错误
+			if err != nil && ctx.Err() == nil {
+				metrics.UpstreamError(req.Model)
+			}
+			return body, err
+		}
+
+		delay := s.retry.backoff(attempt)
+		log.Warn("Cursor API 请求失败（第 %d/%d 次），%v 后重试: %v", attempt, s.retry.MaxAttempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", fmt.Errorf("请求中止: %w", context.Cause(ctx))
+		}
+	}
 }
 
-// doRequest 发送 API 请求
-func (s *Service) doRequest(req CursorChatRequest, onChunk func(chunk string), clientIP string) (string, error) {
-	headers := s.buildChatHeaders(clientIP)
+// doAttempt 发送一次 API 请求
+// onChunk 不为空时每读到一段数据就回调一次，否则累积完整响应后返回；delivered 为已回调的字节数
+func (s *Service) doAttempt(ctx context.Context, acct *account, req CursorChatRequest, onChunk func(chunk string) error, clientIP string) (string, int, error) {
+	headers := s.buildChatHeaders(acct, clientIP)
+
+	sess, err := acct.sessions.acquire(ctx)
+	if err != nil {
+		log.Error("获取会话失败: %v", err)
+		return "", 0, err
+	}
+	defer acct.sessions.release(sess)
 
-	log.Debug("发送请求到 Cursor API: model=%s", req.Model)
+	log.Debug("发送请求到 Cursor API: model=%s, 账号=%s", req.Model, acct.name)
 
-	resp := s.surfClient.Post(g.String(cursorChatAPI), req).SetHeaders(headers).Do()
+	resp := sess.Post(g.String(s.routes.chatURL(req.Model)), req).SetHeaders(headers).WithContext(ctx).Do()
 	if resp.IsErr() {
 		log.Error("Cursor API 请求失败: %v", resp.Err())
-		return "", fmt.Errorf("请求失败: %w", resp.Err())
+		return "", 0, fmt.Errorf("请求失败: %w", &networkError{resp.Err()})
 	}
 
 	r := resp.Ok()
 	if r.StatusCode != 200 {
 		body := string(r.Body.String())
-		log.Error("Cursor API 返回错误: HTTP %d, 响应: %s", r.StatusCode, body)
-		return "", fmt.Errorf("HTTP %d: %s", r.StatusCode, body)
+		log.Error("Cursor API 返回错误: 账号=%s, HTTP %d, 响应: %s", acct.name, r.StatusCode, body)
+		return "", 0, &StatusError{StatusCode: int(r.StatusCode), Body: body}
 	}
+	defer r.Body.Reader.Close()
 
-	bodyStr := string(r.Body.String())
-	if onChunk != nil {
-		onChunk(bodyStr)
+	var body strings.Builder
+	total := 0
+	delivered := 0
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Body.Reader.Read(buf)
+		total += n
+		if n > 0 {
+			if onChunk != nil {
+				cbErr := onChunk(string(buf[:n]))
+				delivered += n
+				if errors.Is(cbErr, ErrStopStream) {
+					log.Debug("调用方停止读取 Cursor API 响应, 已读取: %d", total)
+					return body.String(), delivered, nil
+				}
+				if cbErr != nil {
+					return body.String(), delivered, cbErr
+				}
+			} else {
+				body.Write(buf[:n])
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Debug("Cursor API 请求已中止: %v", context.Cause(ctx))
+				return body.String(), delivered, fmt.Errorf("请求中止: %w", context.Cause(ctx))
+			}
+			log.Error("读取 Cursor API 响应失败: %v", err)
+			return body.String(), delivered, fmt.Errorf("读取响应失败: %w", &networkError{err})
+		}
 	}
 
-	log.Debug("Cursor API 响应成功, 长度: %d", len(bodyStr))
-	return bodyStr, nil
+	log.Debug("Cursor API 响应成功, 长度: %d", total)
+	return body.String(), delivered, nil
 }
 
-// buildChatHeaders 构建聊天请求头
-func (s *Service) buildChatHeaders(clientIP string) map[string]string {
-	headers := make(map[string]string, len(chromeChatHeaders)+3)
+// buildChatHeaders 构建聊天请求头（账号配置的请求头覆盖默认值）
+func (s *Service) buildChatHeaders(acct *account, clientIP string) map[string]string {
+	headers := make(map[string]string, len(chromeChatHeaders)+len(acct.headers)+3)
 	for k, v := range chromeChatHeaders {
 		headers[k] = v
 	}
+	for k, v := range acct.headers {
+		headers[k] = v
+	}
 	headers["x-is-human"] = s.GetXIsHuman()
 	// 转发客户端 IP
 	if clientIP != "" {
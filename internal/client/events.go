@@ -0,0 +1,182 @@
+// Package client 提供 Cursor API 客户端实现
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// CursorEvent Cursor SSE 事件
+type CursorEvent struct {
+	Type  string `json:"type"`
+	Delta string `json:"delta,omitempty"`
+	// ErrorText type 为 error 时上游的错误信息
+	ErrorText string `json:"errorText,omitempty"`
+}
+
+// eventDecoder 把上游 SSE 字节流解码为 Cursor 事件
+// 按字节累积到换行符再解析，跨数据块拆开的多字节字符会在同一行内拼回完整；兼容 \r\n 换行
+type eventDecoder struct {
+	pending strings.Builder
+	// head 响应开头（最多 maxUpstreamErrorBody 字节），上游返回非 SSE 内容时用于生成错误信息
+	head   strings.Builder
+	events int
+	err    error
+}
+
+// maxUpstreamErrorBody 检查非 SSE 响应时保留的最大字节数
+const maxUpstreamErrorBody = 4096
+
+// Feed 追加一段数据，返回其中已完整的事件，未以换行结尾的末行留待下次
+func (d *eventDecoder) Feed(chunk string) []CursorEvent {
+	if rest := maxUpstreamErrorBody - d.head.Len(); rest > 0 {
+		d.head.WriteString(chunk[:min(rest, len(chunk))])
+	}
+	d.pending.WriteString(chunk)
+	content := d.pending.String()
+	end := strings.LastIndexByte(content, '\n')
+	if end < 0 {
+		return nil
+	}
+	d.pending.Reset()
+	d.pending.WriteString(content[end+1:])
+	return d.record(ParseEvents(content[:end]))
+}
+
+// Flush 解析流结束时残留的最后一行
+func (d *eventDecoder) Flush() []CursorEvent {
+	content := d.pending.String()
+	d.pending.Reset()
+	return d.record(ParseEvents(content))
+}
+
+// Err 流结束后检查响应：上游发送了 error 事件，或整个响应都不是 SSE（JSON 错误、HTML 错误页等）时返回错误
+func (d *eventDecoder) Err() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.events > 0 {
+		return nil
+	}
+	return CheckResponse(d.head.String(), nil)
+}
+
+func (d *eventDecoder) record(events []CursorEvent) []CursorEvent {
+	d.events += len(events)
+	if d.err == nil {
+		d.err = eventsError(events)
+	}
+	return events
+}
+
+// responseError 上游返回 200 但响应不是正常的 SSE：error 事件、JSON 错误或 HTML 错误页
+type responseError struct {
+	message string
+}
+
+func (e *responseError) Error() string {
+	return "upstream error: " + e.message
+}
+
+// eventsError 返回事件中第一个 error 事件对应的错误
+func eventsError(events []CursorEvent) error {
+	for _, event := range events {
+		if event.Type == "error" {
+			message := event.ErrorText
+			if message == "" {
+				message = "Cursor returned an error event"
+			}
+			return &responseError{message: message}
+		}
+	}
+	return nil
+}
+
+// CheckResponse 检查完整的上游响应（events 为从中解析出的事件）
+// 有 error 事件，或响应中没有任何 SSE data 行（空响应、JSON 错误、HTML 错误页）时返回 *responseError
+func CheckResponse(body string, events []CursorEvent) error {
+	if err := eventsError(events); err != nil {
+		return err
+	}
+	if len(events) > 0 {
+		return nil
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data:") {
+			return nil
+		}
+	}
+	return &responseError{message: describeNonSSEBody(body)}
+}
+
+// describeNonSSEBody 从非 SSE 响应中提取错误信息：JSON 的 error/message 字段、HTML 的 title，否则取开头的文本
+func describeNonSSEBody(body string) string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "Cursor returned an empty response"
+	}
+
+	var payload map[string]interface{}
+	if json.Unmarshal([]byte(body), &payload) == nil {
+		if e, ok := payload["error"].(map[string]interface{}); ok {
+			if msg, ok := e["message"].(string); ok && msg != "" {
+				return msg
+			}
+		}
+		for _, key := range []string{"error", "message", "detail"} {
+			if msg, ok := payload[key].(string); ok && msg != "" {
+				return msg
+			}
+		}
+	}
+
+	if strings.HasPrefix(body, "<") {
+		lower := strings.ToLower(body)
+		if start := strings.Index(lower, "<title>"); start >= 0 {
+			if end := strings.Index(lower[start:], "</title>"); end >= 0 {
+				return "Cursor returned an HTML page: " + strings.TrimSpace(body[start+len("<title>"):start+end])
+			}
+		}
+		return "Cursor returned an HTML page instead of an event stream"
+	}
+
+	const maxSnippet = 200
+	if len(body) > maxSnippet {
+		cut := maxSnippet
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		body = body[:cut] + "..."
+	}
+	return "Cursor returned a non-SSE response: " + body
+}
+
+// ParseEvents 解析一段完整的 SSE 文本中的所有 data 事件
+func ParseEvents(body string) []CursorEvent {
+	var events []CursorEvent
+	for _, line := range strings.Split(body, "\n") {
+		if event, ok := parseEventLine(line); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// parseEventLine 解析单行 SSE，非 data 行、空数据和 [DONE] 返回 false
+func parseEventLine(line string) (CursorEvent, bool) {
+	var event CursorEvent
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasPrefix(line, "data:") {
+		return event, false
+	}
+	data := strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+	if data == "" || data == "[DONE]" {
+		return event, false
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		log.Debug("忽略无法解析的上游事件: %v, 数据: %s", err, data)
+		return event, false
+	}
+	return event, true
+}
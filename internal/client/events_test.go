@@ -0,0 +1,103 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+// decodeChunks 依次喂入数据块，返回解码出的全部事件
+func decodeChunks(chunks []string) ([]CursorEvent, error) {
+	var d eventDecoder
+	var events []CursorEvent
+	for _, chunk := range chunks {
+		events = append(events, d.Feed(chunk)...)
+	}
+	events = append(events, d.Flush()...)
+	return events, d.Err()
+}
+
+// joinDeltas 拼接 text-delta 事件的文本
+func joinDeltas(events []CursorEvent) string {
+	var b strings.Builder
+	for _, e := range events {
+		if e.Type == "text-delta" {
+			b.WriteString(e.Delta)
+		}
+	}
+	return b.String()
+}
+
+func TestEventDecoderSplitsMultibyteAcrossChunks(t *testing.T) {
+	body := "data: {\"type\":\"text-delta\",\"delta\":\"你好，世界\"}\n\n" +
+		"data: {\"type\":\"text-delta\",\"delta\":\"🚀 done\"}\n\n"
+	// 逐字节切分：每个多字节字符都会被拆到不同的数据块中
+	chunks := make([]string, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		chunks = append(chunks, body[i:i+1])
+	}
+
+	events, err := decodeChunks(chunks)
+	if err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if got := joinDeltas(events); got != "你好，世界🚀 done" {
+		t.Errorf("text = %q", got)
+	}
+}
+
+func TestEventDecoderCRLF(t *testing.T) {
+	body := "data: {\"type\":\"text-delta\",\"delta\":\"line one\"}\r\n\r\n" +
+		"data: {\"type\":\"text-delta\",\"delta\":\"中文\"}\r\n\r\n" +
+		"data: [DONE]\r\n"
+	events, err := decodeChunks([]string{body[:20], body[20:61], body[61:]})
+	if err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if got := joinDeltas(events); got != "line one中文" {
+		t.Errorf("text = %q", got)
+	}
+}
+
+func TestEventDecoderFlushesLastLineWithoutNewline(t *testing.T) {
+	events, err := decodeChunks([]string{`data: {"type":"text-delta","de`, `lta":"tail"}`})
+	if err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if got := joinDeltas(events); got != "tail" {
+		t.Errorf("text = %q, want tail", got)
+	}
+}
+
+func TestCheckResponseNonSSEBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "JSON error object", body: `{"error": {"type": "rate_limit", "message": "Too many requests"}}`, want: "Too many requests"},
+		{name: "JSON error string", body: `{"error": "unauthorized"}`, want: "unauthorized"},
+		{name: "HTML page", body: "<html><head><title>502 Bad Gateway</title></head></html>", want: "502 Bad Gateway"},
+		{name: "empty", body: "  \n", want: "empty response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckResponse(tt.body, ParseEvents(tt.body))
+			if err == nil {
+				t.Fatal("CheckResponse() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResponseSSE(t *testing.T) {
+	body := "data: {\"type\":\"text-delta\",\"delta\":\"hi\"}\n\n"
+	if err := CheckResponse(body, ParseEvents(body)); err != nil {
+		t.Errorf("CheckResponse() error: %v", err)
+	}
+}
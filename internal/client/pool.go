@@ -0,0 +1,104 @@
+// Package client 提供 Cursor API 客户端实现
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/enetx/surf"
+)
+
+// ErrPoolExhausted 等待空闲会话超时
+var ErrPoolExhausted = errors.New("会话池已耗尽")
+
+// sessionPool 可复用的 surf 会话池
+// 每个会话持有独立的连接，并发请求各自取用，避免在同一连接上排队
+type sessionPool struct {
+	sessions    chan *surf.Client
+	size        int
+	waitTimeout time.Duration
+
+	inUse    atomic.Int64
+	acquired atomic.Int64
+	waited   atomic.Int64
+	timeouts atomic.Int64
+}
+
+// PoolStats 会话池使用情况
+type PoolStats struct {
+	Size     int   `json:"size"`
+	InUse    int64 `json:"in_use"`
+	Acquired int64 `json:"acquired"` // 累计取用次数
+	Waited   int64 `json:"waited"`   // 累计需要等待空闲会话的次数
+	Timeouts int64 `json:"timeouts"` // 累计等待超时次数
+}
+
+// newSessionPool 创建会话池，size<=0 时按 1 处理
+func newSessionPool(size int, waitTimeout time.Duration, newSession func() *surf.Client) *sessionPool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &sessionPool{
+		sessions:    make(chan *surf.Client, size),
+		size:        size,
+		waitTimeout: waitTimeout,
+	}
+	for i := 0; i < size; i++ {
+		p.sessions <- newSession()
+	}
+	return p
+}
+
+// acquire 取出一个空闲会话，池耗尽时最多等待 waitTimeout（<=0 一直等到 ctx 结束）
+func (p *sessionPool) acquire(ctx context.Context) (*surf.Client, error) {
+	select {
+	case sess := <-p.sessions:
+		p.onAcquire()
+		return sess, nil
+	default:
+	}
+
+	p.waited.Add(1)
+	var timeout <-chan time.Time
+	if p.waitTimeout > 0 {
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case sess := <-p.sessions:
+		p.onAcquire()
+		return sess, nil
+	case <-timeout:
+		p.timeouts.Add(1)
+		return nil, fmt.Errorf("%w: 等待 %v 后仍无空闲会话（共 %d 个）", ErrPoolExhausted, p.waitTimeout, p.size)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("请求中止: %w", context.Cause(ctx))
+	}
+}
+
+// release 归还会话
+func (p *sessionPool) release(sess *surf.Client) {
+	p.inUse.Add(-1)
+	p.sessions <- sess
+}
+
+func (p *sessionPool) onAcquire() {
+	p.inUse.Add(1)
+	p.acquired.Add(1)
+}
+
+// stats 返回会话池使用情况
+func (p *sessionPool) stats() PoolStats {
+	return PoolStats{
+		Size:     p.size,
+		InUse:    p.inUse.Load(),
+		Acquired: p.acquired.Load(),
+		Waited:   p.waited.Load(),
+		Timeouts: p.timeouts.Load(),
+	}
+}
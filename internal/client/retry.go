@@ -0,0 +1,60 @@
+// Package client 提供 Cursor API 客户端实现
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy 上游请求重试策略
+type RetryPolicy struct {
+	// MaxAttempts 最大尝试次数（含第一次），<=1 表示不重试
+	MaxAttempts int
+	// BaseDelay 首次重试的基础等待时间，之后每次翻倍
+	BaseDelay time.Duration
+	// MaxDelay 单次等待时间上限（<=0 不限制）
+	MaxDelay time.Duration
+}
+
+// backoff 计算第 attempt 次失败后的等待时间：指数退避 + 完全随机抖动
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(delay)) + 1)
+}
+
+// StatusError Cursor API 返回的非 200 响应
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// networkError 连接或读取响应时的网络错误
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string { return e.err.Error() }
+
+func (e *networkError) Unwrap() error { return e.err }
+
+// retryable 判断错误是否值得重试：网络错误和 5xx 重试，4xx 不重试
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var netErr *networkError
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,43 @@
+// Package client 提供 Cursor API 客户端实现
+package client
+
+import (
+	"strings"
+
+	"cursor2api/internal/config"
+)
+
+// upstreamRoutes 按 Cursor 模型选择上游地址
+type upstreamRoutes struct {
+	baseURL string
+	routes  map[string]string // 小写模型名子串 -> 基础地址
+}
+
+// newUpstreamRoutes 根据配置创建路由表（地址格式已在启动时由 UpstreamConfig.Validate 校验）
+func newUpstreamRoutes(cfg config.UpstreamConfig) upstreamRoutes {
+	r := upstreamRoutes{
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		routes:  make(map[string]string, len(cfg.ModelRoutes)),
+	}
+	for model, route := range cfg.ModelRoutes {
+		r.routes[strings.ToLower(model)] = strings.TrimRight(route, "/")
+	}
+	return r
+}
+
+// baseURLFor 返回模型对应的基础地址：键按子串匹配模型名（忽略大小写），取最长匹配，未匹配时使用默认地址
+func (r upstreamRoutes) baseURLFor(model string) string {
+	model = strings.ToLower(model)
+	best, matched := r.baseURL, ""
+	for key, route := range r.routes {
+		if strings.Contains(model, key) && len(key) > len(matched) {
+			best, matched = route, key
+		}
+	}
+	return best
+}
+
+// chatURL 返回模型对应的聊天接口地址
+func (r upstreamRoutes) chatURL(model string) string {
+	return r.baseURLFor(model) + cursorChatPath
+}
@@ -3,16 +3,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/metrics"
 	"cursor2api/internal/toolify"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 // 注意: log 变量在 openai.go 中定义
@@ -20,13 +25,47 @@ import (
 // ================== 请求/响应结构体 ==================
 
 // MessagesRequest Anthropic Messages API 请求格式
+// 未列出的字段（如 LiteLLM 等客户端附带的扩展字段）解码时直接忽略，不会导致请求被拒绝
 type MessagesRequest struct {
 	Model     string                   `json:"model"`
 	Messages  []Message                `json:"messages"`
 	MaxTokens int                      `json:"max_tokens"`
-	Stream    bool                     `json:"stream"`
+	Stream    *bool                    `json:"stream"`           // 未设置时根据 Accept 头判断
 	System    interface{}              `json:"system,omitempty"` // 可以是 string 或 []ContentBlock
 	Tools     []toolify.ToolDefinition `json:"tools,omitempty"`
+	// ToolChoice 工具选择：auto / any / tool（指定 name）/ none
+	ToolChoice *toolify.ToolChoice `json:"tool_choice,omitempty"`
+	// StopSequences 停止序列，命中后截断输出
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	// 采样参数
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	// Thinking 扩展思考，开启时返回上游的推理内容
+	Thinking *ThinkingConfig `json:"thinking,omitempty"`
+	// CursorContext 发送给 Cursor 的上下文（扩展字段），未设置时使用 cursor_context 配置
+	CursorContext []client.CursorContext `json:"cursor_context,omitempty"`
+	// Metadata 请求元数据，user_id 会记录在请求日志中（Cursor 没有对应字段，不转发）
+	Metadata *RequestMetadata `json:"metadata,omitempty"`
+	// User 终端用户标识（LiteLLM 等 OpenAI 风格客户端发送的扩展字段），metadata.user_id 为空时使用
+	User string `json:"user,omitempty"`
+
+	// noSystemAffix 不追加 system_affix 配置的前缀/后缀（请求头 X-No-System-Affix）
+	noSystemAffix bool
+}
+
+// RequestMetadata 请求元数据
+type RequestMetadata struct {
+	// UserID 客户端提供的终端用户标识（不透明字符串）
+	UserID string `json:"user_id,omitempty"`
+}
+
+// endUser 返回请求中的终端用户标识：优先 metadata.user_id，其次 user 字段
+func (r *MessagesRequest) endUser() string {
+	if r.Metadata != nil && r.Metadata.UserID != "" {
+		return r.Metadata.UserID
+	}
+	return r.User
 }
 
 // Message 消息格式
@@ -49,34 +88,28 @@ type MessagesResponse struct {
 
 // ContentBlock 内容块
 type ContentBlock struct {
-	Type  string                 `json:"type"`
-	Text  string                 `json:"text,omitempty"`
-	ID    string                 `json:"id,omitempty"`    // tool_use
-	Name  string                 `json:"name,omitempty"`  // tool_use
-	Input map[string]interface{} `json:"input,omitempty"` // tool_use
+	Type      string      `json:"type"`
+	Text      string      `json:"text,omitempty"`
+	Thinking  string      `json:"thinking,omitempty"`  // thinking
+	Signature *string     `json:"signature,omitempty"` // thinking，上游不提供签名，始终为空字符串
+	ID        string      `json:"id,omitempty"`        // tool_use
+	Name      string      `json:"name,omitempty"`      // tool_use
+	Input     interface{} `json:"input,omitempty"`     // tool_use，始终为对象（可能为空对象）
 }
 
 // Usage token 使用统计
 type Usage struct {
 	InputTokens  int `json:"input_tokens"`
 	OutputTokens int `json:"output_tokens"`
-}
-
-// CursorSSEEvent Cursor SSE 事件格式
-type CursorSSEEvent struct {
-	Type  string `json:"type"`
-	Delta string `json:"delta,omitempty"`
+	// 提示词缓存用量：Cursor 目前不支持缓存，始终为 0；与 Anthropic 一致总是返回，避免严格的客户端反序列化失败
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
 }
 
 // ================== 辅助函数 ==================
 
-// generateID 生成唯一标识符
-func generateID() string {
-	return strings.ReplaceAll(uuid.New().String(), "-", "")[:16]
-}
-
 // getTextContent 从 interface{} 提取文本内容
-// 支持 string 和 []ContentBlock 两种格式
+// 支持 string、单个内容块和 []ContentBlock 格式（忽略 cache_control 等非文本字段）
 func getTextContent(content interface{}) string {
 	if content == nil {
 		return ""
@@ -84,15 +117,17 @@ func getTextContent(content interface{}) string {
 	switch v := content.(type) {
 	case string:
 		return v
+	case map[string]interface{}:
+		return getTextContent([]interface{}{v})
 	case []interface{}:
 		var texts []string
 		for _, item := range v {
-			if block, ok := item.(map[string]interface{}); ok {
-				if block["type"] == "text" {
-					if text, ok := block["text"].(string); ok {
-						texts = append(texts, text)
-					}
-				}
+			if text, ok := textBlockContent(item); ok {
+				texts = append(texts, text)
+			} else if block, ok := item.(map[string]interface{}); ok && block["type"] == "image" {
+				texts = append(texts, describeUnsupportedBlock(block))
+			} else if ok && block["type"] == "document" {
+				texts = append(texts, documentBlockText(block))
 			}
 		}
 		return strings.Join(texts, "\n")
@@ -101,14 +136,33 @@ func getTextContent(content interface{}) string {
 	}
 }
 
-// mapModelName 将模型名称映射到 Cursor 支持的格式
-func mapModelName(model string) string {
-	// 统一使用 claude-opus-4-5-20251101
-	const targetModel = "claude-opus-4-5-20251101"
-	if model != targetModel {
-		log.Debug("模型映射: %s -> %s", model, targetModel)
+// resolveCursorModel 确定本次请求使用的 Cursor 模型
+// 查询参数 cursor_model 可绕过模型映射直接指定（便于用 curl 调试路由），但必须是已知的 Cursor 模型（见 knownCursorModels）
+func resolveCursorModel(c *gin.Context, model string) (string, error) {
+	override := c.Query("cursor_model")
+	if override == "" {
+		cursorModel, err := lookupModel(model)
+		if err != nil {
+			return "", err
+		}
+		return cursorModel, checkModelAllowed(c, cursorModel)
 	}
-	return targetModel
+	known := knownCursorModels()
+	for _, target := range known {
+		if strings.EqualFold(override, target) {
+			log.Debug("模型覆盖 (cursor_model): %s -> %s", model, target)
+			return target, checkModelAllowed(c, target)
+		}
+	}
+	return "", fmt.Errorf("cursor_model: unknown Cursor model %q, known models: %s", override, strings.Join(known, ", "))
+}
+
+// abortWithError 返回 Anthropic 格式的错误响应
+func abortWithError(c *gin.Context, status int, errType, message string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"type":  "error",
+		"error": gin.H{"type": errType, "message": message},
+	})
 }
 
 // ================== 处理器函数 ==================
@@ -117,20 +171,51 @@ func mapModelName(model string) string {
 func CountTokens(c *gin.Context) {
 	var req MessagesRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error()}})
+		status, errType := bindErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
+	}
+	req.noSystemAffix = skipSystemAffix(c)
+	if err := validateMessageLimits(messageContents(req.Messages)); err != nil {
+		status, errType := validationErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
+	}
+	if err := validateUserContent(req.Messages); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
 		return
 	}
 
-	// 简单估算：每 4 个字符约 1 个 token
-	totalChars := len(getTextContent(req.System))
-	for _, msg := range req.Messages {
-		totalChars += len(getTextContent(msg.Content))
+	cursorModel, err := lookupModel(req.Model)
+	if err == nil {
+		err = checkModelAllowed(c, cursorModel)
 	}
-	tokens := totalChars / 4
-	if tokens < 1 {
-		tokens = 1
+	if err != nil {
+		status, errType := modelErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
 	}
 
+	// 按实际发往 Cursor 的内容计数（含系统提示与工具提示词），编码随映射后的模型选择；
+	// 再加上工具定义的 schema 和图片的估算值（Cursor 收到的只是图片占位文本），与 Anthropic 的计数方式一致
+	messageTokens := countInputTokens(convertToCursor(req, cursorModel))
+	toolTokens := countToolTokens(req.Tools, cursorModel)
+	imgTokens, images := countImageTokens(req.Messages)
+	tokens := max(messageTokens+toolTokens+imgTokens, 1)
+
+	// ?debug=true 时返回各部分的明细
+	if debug, _ := strconv.ParseBool(c.Query("debug")); debug {
+		c.JSON(http.StatusOK, gin.H{
+			"input_tokens": tokens,
+			"breakdown": gin.H{
+				"messages":    messageTokens,
+				"tools":       toolTokens,
+				"images":      imgTokens,
+				"image_count": images,
+			},
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"input_tokens": tokens})
 }
 
@@ -152,63 +237,149 @@ func getClientIP(c *gin.Context) string {
 	return c.ClientIP()
 }
 
+// wantsStream 判断请求是否需要流式响应
+// 显式设置的 stream 字段优先；未设置时若 Accept 头包含 text/event-stream 则按流式处理
+func wantsStream(c *gin.Context, stream *bool) bool {
+	if stream != nil {
+		return *stream
+	}
+	return strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
 // Messages 处理 Anthropic Messages API 请求
 func Messages(c *gin.Context) {
+	start := time.Now()
+	rlog := requestLogger(c)
+
 	// 记录请求 Headers
-	log.Debug("[Anthropic] ========== 请求开始 ==========")
-	log.Debug("[Anthropic] 请求路径: %s", c.Request.URL.String())
-	log.Debug("[Anthropic] 请求头:")
-	for key, values := range c.Request.Header {
-		log.Debug("  %s: %s", key, strings.Join(values, ", "))
-	}
+	rlog.Debug("[Anthropic] ========== 请求开始 ==========")
+	rlog.Debug("[Anthropic] 请求路径: %s", c.Request.URL.String())
+	logRequestHeaders(rlog, c)
 
 	var req MessagesRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		log.Error("[Anthropic] 解析请求失败: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error()}})
+		rlog.Error("[Anthropic] 解析请求失败: %v", err)
+		if bodyTooLarge(err) {
+			abortWithError(c, http.StatusRequestEntityTooLarge, "request_too_large", err.Error())
+			return
+		}
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	req.noSystemAffix = skipSystemAffix(c)
+
+	if err := validateMessageLimits(messageContents(req.Messages)); err != nil {
+		status, errType := validationErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
 		return
 	}
 
-	// 记录请求参数
-	log.Info("[Anthropic] 请求参数:")
-	log.Info("  模型: %s", req.Model)
-	log.Info("  消息数: %d", len(req.Messages))
-	log.Info("  最大Token: %d", req.MaxTokens)
-	log.Info("  流式: %v", req.Stream)
-	if len(req.Tools) > 0 {
-		log.Info("  工具数: %d", len(req.Tools))
+	if err := validateUserContent(req.Messages); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
 	}
+	if err := validateStopSequences(req.StopSequences); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if err := validateContentBlocks(req.Messages); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if err := validateToolChoice(req.ToolChoice, req.Tools); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	stream := wantsStream(c, req.Stream)
 
-	// 记录消息内容
-	for i, msg := range req.Messages {
-		content := getTextContent(msg.Content)
-		if len(content) > 200 {
-			content = content[:200] + "..."
+	// 记录消息内容（log_content 开启时）
+	if logContent() {
+		for i, msg := range req.Messages {
+			content := getTextContent(msg.Content)
+			if len(content) > 200 {
+				content = content[:200] + "..."
+			}
+			rlog.Debug("  消息[%d] 角色=%s 内容=%s", i, msg.Role, content)
 		}
-		log.Debug("  消息[%d] 角色=%s 内容=%s", i, msg.Role, content)
 	}
 
 	// 转换为 Cursor 请求格式
-	cursorReq := convertToCursor(req)
+	cursorModel, err := resolveCursorModel(c, req.Model)
+	if err != nil {
+		status, errType := modelErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
+	}
+
+	defer metrics.ObserveRequest("messages", cursorModel, stream, start)
+
+	if req.MaxTokens, err = resolveMaxTokens(cursorModel, req.MaxTokens); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	// 记录请求摘要
+	rlog.Info("[Anthropic] 请求: 模型=%s -> %s, 消息数=%d, 工具数=%d, 最大Token=%d, 流式=%v",
+		req.Model, cursorModel, len(req.Messages), len(req.Tools), req.MaxTokens, stream)
+	if user := req.endUser(); user != "" {
+		rlog.Info("[Anthropic] 终端用户: %s", user)
+	}
+
+	cursorReq := convertToCursor(req, cursorModel)
+	if ferr := filterInput(&cursorReq); ferr != nil {
+		abortWithError(c, ferr.Status, ferr.Type, ferr.Message)
+		return
+	}
+	// capture.rate 抽中的请求在处理结束后记录完整的请求/响应
+	if capture := sampleCapture(c); capture != nil {
+		defer capture.write(&req, &cursorReq)
+	}
 	clientIP := getClientIP(c)
-	log.Debug("[Anthropic] 客户端 IP: %s", clientIP)
+	rlog.Debug("[Anthropic] 客户端 IP: %s", clientIP)
+
+	// tool_choice=none 或请求头 X-No-Tools 时不解析工具调用，原样返回模型文本
+	tools := req.Tools
+	if req.ToolChoice.IsNone() {
+		tools = nil
+	} else if skipToolParsing(c) {
+		rlog.Info("[Anthropic] X-No-Tools: 跳过工具调用解析，原样返回模型文本")
+		tools = nil
+	}
 
-	if req.Stream {
-		handleStream(c, cursorReq, req.Model, req.Tools, clientIP)
+	ctx, cancel := requestContext(c, "[Anthropic]")
+	defer cancel()
+
+	if stream {
+		handleStream(ctx, c, cursorReq, req.Model, tools, req.StopSequences, assistantPrefill(req.Messages), thinkingEnabled(req), clientIP)
 	} else {
-		handleNonStream(c, cursorReq, req.Model, req.Tools, clientIP)
+		handleNonStream(ctx, c, cursorReq, req.Model, tools, req.StopSequences, assistantPrefill(req.Messages), thinkingEnabled(req), clientIP)
 	}
 }
 
 // ================== 请求转换 ==================
 
-// convertToCursor 将 Anthropic 请求转换为 Cursor 格式
-func convertToCursor(req MessagesRequest) client.CursorChatRequest {
+// convertToCursor 将 Anthropic 请求转换为 Cursor 格式（使用默认转换选项）
+// cursorModel 为已解析的 Cursor 模型（见 resolveCursorModel）
+func convertToCursor(req MessagesRequest, cursorModel string) client.CursorChatRequest {
+	return convert(req, cursorModel, newConvertOptions(req, nil))
+}
+
+// traceConvertToCursor 与 convertToCursor 相同，同时返回组装的系统提示词和工具提示词
+func traceConvertToCursor(req MessagesRequest, cursorModel string) (client.CursorChatRequest, conversionTrace) {
+	o := newConvertOptions(req, nil)
+	o.trace = &conversionTrace{}
+	return convert(req, cursorModel, o), *o.trace
+}
+
+// convert 按转换选项将 Anthropic 请求转换为 Cursor 格式
+func convert(req MessagesRequest, cursorModel string, o *convertOptions) client.CursorChatRequest {
 	messages := make([]client.CursorMessage, 0, len(req.Messages)+1)
 
-	// 构建系统消息
-	sysText := getTextContent(req.System)
-	if sysText != "" {
+	// 构建系统消息（部分模型需要把系统提示并入第一条用户消息）
+	sysText := o.system(buildSystemText(req.System))
+	prependSystem := systemPromptMode(cursorModel) == systemModePrepend
+	if sysText != "" && !prependSystem {
 		messages = append(messages, client.CursorMessage{
 			Parts: []client.CursorPart{{Type: "text", Text: sysText}},
 			ID:    generateID(),
@@ -235,63 +406,110 @@ func convertToCursor(req MessagesRequest) client.CursorChatRequest {
 
 	// 只有第一次调用时才注入工具提示（没有 tool_result）
 	toolPrompt := ""
-	if len(req.Tools) > 0 && !hasToolResult {
-		toolPrompt = toolify.GenerateToolPrompt(req.Tools)
+	if req.ToolChoice.IsNone() {
+		log.Debug("[Anthropic] tool_choice=none，不注入工具提示词")
+	} else if len(req.Tools) > 0 && !hasToolResult {
+		toolPrompt = o.toolPrompt(req.Tools, req.ToolChoice)
 		log.Info("[Anthropic] 注入工具提示词, 长度: %d, 工具数: %d", len(toolPrompt), len(req.Tools))
-		log.Debug("[Anthropic] 工具提示词内容:\n%s", toolPrompt)
+		if logContent() {
+			log.Debug("[Anthropic] 工具提示词内容:\n%s", toolPrompt)
+		}
 	} else if len(req.Tools) > 0 && hasToolResult {
 		log.Debug("[Anthropic] 跳过工具提示词注入 (已有 tool_result)")
 	}
 
-	// 添加用户/助手消息
+	if o.trace != nil {
+		o.trace.System = sysText
+		o.trace.ToolPrompt = toolPrompt
+	}
+
+	// 需要放在第一条用户消息前面的内容
+	var prefixes []string
+	if prependSystem && sysText != "" {
+		log.Debug("[Anthropic] 模型 %s 的系统提示词并入第一条用户消息", cursorModel)
+		prefixes = append(prefixes, sysText)
+	}
+	if toolPrompt != "" {
+		prefixes = append(prefixes, toolPrompt)
+	}
+
+	// 添加用户/助手消息（每个内容块一个 part，保留块边界）
+	toolUses := collectToolUses(req.Messages)
 	firstUserMsg := true
 	for _, msg := range req.Messages {
-		text := extractMessageText(msg)
-		if text != "" {
-			// 把工具提示放在第一条用户消息前面
-			if msg.Role == "user" && firstUserMsg && toolPrompt != "" {
-				log.Debug("[Anthropic] 工具提示词已注入到第一条用户消息")
-				text = toolPrompt + "\n\n" + text
+		parts := extractMessageParts(msg, toolUses)
+		if len(parts) > 0 {
+			// 把系统提示/工具提示放在第一条用户消息前面
+			if msg.Role == "user" && firstUserMsg && len(prefixes) > 0 {
+				log.Debug("[Anthropic] 前置提示词已注入到第一条用户消息")
+				prefixParts := make([]client.CursorPart, 0, len(prefixes)+len(parts))
+				for _, prefix := range prefixes {
+					prefixParts = append(prefixParts, client.CursorPart{Type: "text", Text: prefix})
+				}
+				parts = append(prefixParts, parts...)
 				firstUserMsg = false
 			}
 			messages = append(messages, client.CursorMessage{
-				Parts: []client.CursorPart{{Type: "text", Text: text}},
+				Parts: parts,
 				ID:    generateID(),
 				Role:  msg.Role,
 			})
 		}
 	}
 
-	return client.CursorChatRequest{
-		Model:    mapModelName(req.Model),
-		ID:       generateID(),
-		Messages: messages,
-		Trigger:  "submit-message",
+	// 末尾为 assistant 消息（预填充）：追加用户消息，要求模型从预填充的末尾接着写
+	if assistantPrefill(req.Messages) != "" {
+		log.Debug("[Anthropic] 末尾为 assistant 预填充，要求模型接着输出")
+		messages = append(messages, client.CursorMessage{
+			Parts: []client.CursorPart{{Type: "text", Text: prefillInstruction}},
+			ID:    generateID(),
+			Role:  "user",
+		})
+	}
+
+	cursorReq := client.CursorChatRequest{
+		Context:   cursorContext(req.CursorContext),
+		Model:     cursorModel,
+		ID:        generateID(),
+		Messages:  messages,
+		Trigger:   "submit-message",
+		MaxTokens: req.MaxTokens,
 	}
+	applySamplingParams(&cursorReq, req)
+	return cursorReq
 }
 
-// extractMessageText 从消息中提取文本
-func extractMessageText(msg Message) string {
+// extractMessageParts 将消息内容转换为 Cursor 消息 part，每个内容块一个 part
+// 块上的 cache_control 标记保留在 part 中
+func extractMessageParts(msg Message, toolUses map[string]toolUse) []client.CursorPart {
 	content := msg.Content
 	if content == nil {
-		return ""
+		return nil
 	}
 
 	switch v := content.(type) {
 	case string:
-		return v
+		if v == "" {
+			return nil
+		}
+		return []client.CursorPart{{Type: "text", Text: v}}
 	case []interface{}:
-		var texts []string
+		var parts []client.CursorPart
 		for _, item := range v {
 			block, ok := item.(map[string]interface{})
 			if !ok {
 				continue
 			}
+			var text string
 			switch block["type"] {
 			case "text":
-				if text, ok := block["text"].(string); ok {
-					texts = append(texts, text)
-				}
+				text, _ = block["text"].(string)
+			case "tool_use":
+				text = toolUseText(block)
+			case "thinking", "redacted_thinking":
+				text = thinkingBlockText(block)
+			case "document":
+				text = documentBlockText(block)
 			case "tool_result":
 				// 提取 tool_result 内容
 				toolID := ""
@@ -304,215 +522,588 @@ func extractMessageText(msg Message) string {
 				} else if c, ok := block["content"].([]interface{}); ok {
 					for _, item := range c {
 						if b, ok := item.(map[string]interface{}); ok {
-							if b["type"] == "text" {
+							switch b["type"] {
+							case "text":
 								if t, ok := b["text"].(string); ok {
 									resultContent += t
 								}
+							case "image":
+								resultContent += describeUnsupportedBlock(b)
+							case "document":
+								resultContent += documentBlockText(b)
 							}
 						}
 					}
 				}
-				texts = append(texts, fmt.Sprintf("[Tool %s result]: %s", toolID, resultContent))
+				resultContent = guardToolResult(toolID, resultContent)
+				text = fmt.Sprintf("%s: %s", toolResultLabel(toolID, toolUses), resultContent)
+			default:
+				// 图片等无法转发的内容块以占位文本代替（unsupported_blocks=reject 时已在入口拒绝）
+				if blockType, _ := block["type"].(string); !supportedBlockTypes[blockType] {
+					text = describeUnsupportedBlock(block)
+				}
 			}
+			if text == "" {
+				continue
+			}
+			parts = append(parts, client.CursorPart{
+				Type:         "text",
+				Text:         text,
+				CacheControl: blockCacheControl(block),
+			})
 		}
-		return strings.Join(texts, "\n")
+		return parts
 	default:
-		return fmt.Sprintf("%v", v)
+		return []client.CursorPart{{Type: "text", Text: fmt.Sprintf("%v", v)}}
 	}
 }
 
 // ================== API 处理 ==================
 
 // handleStream 处理流式请求
-func handleStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, clientIP string) {
+// prefill 为请求末尾 assistant 消息的预填充文本，模型在输出开头重复时去掉
+func handleStream(ctx context.Context, c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, stopSequences []string, prefill string, thinking bool, clientIP string) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 	c.Header("X-Accel-Buffering", "no")
 
-	flusher, _ := c.Writer.(http.Flusher)
-	id := "msg_" + generateID()
+	out := newSSEWriter(c.Writer, streamFlusher(c))
+	ids := newResponseIDs(c)
+	id := ids.message()
 
 	// 发送 message_start
-	_, _ = c.Writer.WriteString("event: message_start\n")
-	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_start","message":{"id":"%s","type":"message","role":"assistant","content":[],"model":"%s","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":100,"output_tokens":0}}}`+"\n\n", id, model)
-	flusher.Flush()
+	inputTokens := countInputTokens(cursorReq)
+	writeSSE(out, "message_start", gin.H{
+		"type": "message_start",
+		"message": gin.H{
+			"id":            id,
+			"type":          "message",
+			"role":          "assistant",
+			"content":       []ContentBlock{},
+			"model":         model,
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         Usage{InputTokens: inputTokens},
+		},
+	})
+	out.Flush()
 
-	var buffer, fullResponse strings.Builder
+	// 上游迟迟没有输出时定期发送 ping，避免代理或浏览器因连接空闲而断开
+	stopPing := out.startPing(time.Duration(config.Get().PingInterval) * time.Second)
+	defer stopPing()
+
+	var fullResponse strings.Builder
 	blockIndex := 0
-	toolCount := 0
+	// 已下发的工具调用，用于结束时统计 output_tokens
+	var sentTools []ContentBlock
+
+	// usage_update_tokens 开启时随输出发送中间 message_delta，带 output_tokens 的滚动估算值
+	estimate := newOutputTokenEstimate(cursorReq.Model, config.Get().UsageUpdateTokens)
+	reportUsage := func(text string) {
+		outputTokens, ok := estimate.Add(text)
+		if !ok {
+			return
+		}
+		writeSSE(out, "message_delta", gin.H{
+			"type":  "message_delta",
+			"delta": gin.H{"stop_reason": nil, "stop_sequence": nil},
+			"usage": Usage{InputTokens: inputTokens, OutputTokens: outputTokens},
+		})
+	}
 
 	// 发送工具调用的辅助函数
-	sendToolCall := func(toolName, argsJSON string) {
-		toolID := fmt.Sprintf("toolu_%d", toolCount)
-		toolCount++
+	sendToolCall := func(toolName string, args map[string]interface{}) {
+		toolID := ids.toolUse()
+
+		sentTools = append(sentTools, ContentBlock{Type: "tool_use", ID: toolID, Name: toolName, Input: args})
 
-		var args map[string]any
-		_ = json.Unmarshal([]byte(argsJSON), &args)
 		inputJSON, _ := json.Marshal(args)
-		partialJSONStr, _ := json.Marshal(string(inputJSON))
-
-		_, _ = c.Writer.WriteString("event: content_block_start\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"tool_use","id":"%s","name":"%s","input":{}}}`+"\n\n", blockIndex, toolID, toolName)
-		_, _ = c.Writer.WriteString("event: content_block_delta\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"input_json_delta","partial_json":%s}}`+"\n\n", blockIndex, string(partialJSONStr))
-		_, _ = c.Writer.WriteString("event: content_block_stop\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
+
+		writeSSE(out, "content_block_start", gin.H{
+			"type":          "content_block_start",
+			"index":         blockIndex,
+			"content_block": gin.H{"type": "tool_use", "id": toolID, "name": toolName, "input": gin.H{}},
+		})
+		// 与 Anthropic 一致，把输入 JSON 拆成多个 input_json_delta 增量下发
+		for _, fragment := range splitJSONFragments(string(inputJSON), inputJSONFragmentSize) {
+			writeSSE(out, "content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "input_json_delta", "partial_json": fragment},
+			})
+		}
+		writeSSE(out, "content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
 		blockIndex++
-		flusher.Flush()
+		reportUsage(toolName + string(inputJSON))
+		out.Flush()
+	}
+
+	// 思考块（仅 thinking 开启时下发，且必须位于文本块之前）
+	var thinkingText strings.Builder
+	thinkingBlockStarted := false
+	sendThinking := func(text string) {
+		thinkingText.WriteString(text)
+		if !thinkingBlockStarted {
+			writeSSE(out, "content_block_start", gin.H{
+				"type":          "content_block_start",
+				"index":         blockIndex,
+				"content_block": gin.H{"type": "thinking", "thinking": "", "signature": ""},
+			})
+			thinkingBlockStarted = true
+		}
+		writeSSE(out, "content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": blockIndex,
+			"delta": gin.H{"type": "thinking_delta", "thinking": text},
+		})
+		reportUsage(text)
+		out.Flush()
+	}
+	// 结束思考块，之后的推理内容不再下发
+	thinkingDone := !thinking
+	finishThinking := func() {
+		if thinkingDone {
+			return
+		}
+		thinkingDone = true
+		if thinkingBlockStarted {
+			writeSSE(out, "content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+			out.Flush()
+			blockIndex++
+		}
 	}
 
 	// 标记是否已发送文本块开始
 	textBlockStarted := false
 
-	svc := client.GetService()
-	err := svc.SendStreamRequestWithIP(cursorReq, func(chunk string) {
-		buffer.WriteString(chunk)
-		content := buffer.String()
-		lines := strings.Split(content, "\n")
+	// 写出文本增量事件
+	writeTextDelta := func(text string) {
+		// 工具调用之后的新文本块去掉开头的空白（标记之间的换行）
+		if !textBlockStarted && len(sentTools) > 0 {
+			text = strings.TrimLeft(text, " \t\r\n")
+		}
+		if text == "" {
+			return
+		}
 
-		if !strings.HasSuffix(content, "\n") && len(lines) > 0 {
-			buffer.Reset()
-			buffer.WriteString(lines[len(lines)-1])
-			lines = lines[:len(lines)-1]
-		} else {
-			buffer.Reset()
+		finishThinking()
+		if !textBlockStarted {
+			writeSSE(out, "content_block_start", gin.H{
+				"type":          "content_block_start",
+				"index":         blockIndex,
+				"content_block": gin.H{"type": "text", "text": ""},
+			})
+			textBlockStarted = true
 		}
 
-		for _, line := range lines {
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "" {
-				continue
-			}
+		writeSSE(out, "content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": blockIndex,
+			"delta": gin.H{"type": "text_delta", "text": text},
+		})
+		reportUsage(text)
+		out.Flush()
+	}
 
-			var event CursorSSEEvent
-			if err := json.Unmarshal([]byte(data), &event); err != nil {
-				continue
+	// 文本依次经过输出过滤（output_filters）和空白合并后下发
+	filters := newOutputFilter()
+	whitespace := newWhitespaceCollapser()
+	emitText := func(text string) {
+		writeTextDelta(whitespace.Apply(filters.Apply(text)))
+	}
+
+	// 结束当前文本块，之后的内容（工具调用或新的文本）使用新的 index
+	finishText := func() {
+		writeTextDelta(whitespace.Apply(filters.Flush()))
+		writeTextDelta(whitespace.Flush())
+		if textBlockStarted {
+			writeSSE(out, "content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+			out.Flush()
+			blockIndex++
+			textBlockStarted = false
+		}
+	}
+
+	// 停止序列检测（保留末尾字节以捕获跨 delta 的停止序列）
+	stops := newStopMatcher(stopSequences)
+	stopped := false
+	// 去掉输出开头重复的预填充文本（在停止序列检测之前）
+	prefillTrim := newPrefillTrimmer(prefill)
+
+	// 只有请求声明了工具时才解析工具调用（与非流式一致）：文本和工具调用按在响应中出现的顺序下发
+	// 每个工具调用的标记一完整就立即下发 tool_use 块，不等待流结束；跨 chunk 的标记由 splitter 缓存到完整后再解析
+	rlog := requestLogger(c)
+	var splitter *toolify.Stream
+	if len(tools) > 0 {
+		splitter = toolParser().NewStream()
+	}
+	toolFilter := newToolCallFilter(rlog)
+	var toolErr error
+	truncatedTool := false
+	handleSegments := func(segments []toolify.Segment) {
+		for _, seg := range segments {
+			if toolErr != nil {
+				return
+			}
+			switch {
+			case seg.Partial && !stopped:
+				// 流在工具调用中途结束：发送已收到的部分输入，让客户端知道有工具正在被调用
+				// 起始标签本身不完整（如 `<vm_write path="a`）时无法识别工具，按普通文本下发
+				partial := toolify.ParsePartialToolCall(seg.Text)
+				if partial == nil {
+					emitText(seg.Text)
+					continue
+				}
+				rlog.Warn("[Anthropic] 工具调用被截断: %s", partial.Function.Name)
+				var args map[string]interface{}
+				if err := json.Unmarshal([]byte(partial.Function.Arguments), &args); err != nil || args == nil {
+					args = map[string]interface{}{}
+				}
+				finishThinking()
+				finishText()
+				sendToolCall(partial.Function.Name, args)
+				truncatedTool = true
+			case len(seg.Calls) > 0:
+				for _, call := range toolFilter.filter(seg.Calls) {
+					// 校验工具参数（缺失时规范化为空对象）
+					args, err := resolveToolInput(tools, call.Function.Name, call.Function.Arguments)
+					if err != nil {
+						toolErr = err
+						return
+					}
+					finishThinking()
+					finishText()
+					sendToolCall(call.Function.Name, args)
+				}
+			default:
+				emitText(seg.Text)
 			}
+		}
+	}
 
-			if event.Type == "text-delta" && event.Delta != "" {
-				fullResponse.WriteString(event.Delta)
+	// 发送文本增量的辅助函数（fullResponse 保留原始文本，下发时按配置过滤和合并空白）
+	sendText := func(text string) {
+		fullResponse.WriteString(text)
+		if splitter == nil {
+			emitText(text)
+			return
+		}
+		handleSegments(splitter.Feed(text))
+	}
 
+	start := time.Now()
+	handleEvents := func(events []client.CursorEvent) {
+		for _, event := range events {
+			if event.Type == cursorReasoningDelta && event.Delta != "" && !thinkingDone && !stopped {
+				sendThinking(event.Delta)
+			}
+			if event.Type == "text-delta" && event.Delta != "" && !stopped {
 				// 实时发送文本块
-				if !textBlockStarted {
-					_, _ = c.Writer.WriteString("event: content_block_start\n")
-					_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"text","text":""}}`+"\n\n", blockIndex)
-					textBlockStarted = true
+				var text string
+				text, stopped = stops.Feed(prefillTrim.Feed(event.Delta))
+				sendText(text)
+			}
+		}
+	}
+	// refusal.strategy=reprompt 时开头的内容先经过拒绝检测，判定为拒绝时丢弃并追加引导语重新请求
+	var err error
+	for reprompts, limit := 0, maxReprompts(); ; reprompts++ {
+		var gate *refusalGate
+		if reprompts < limit {
+			gate = newRefusalGate()
+		}
+		refused := false
+		// 上游在返回任何事件之前失败时按 model_fallbacks 回退，已有内容下发后不再回退
+		cursorReq, err = streamWithFallback(ctx, c, cursorReq, func(events []client.CursorEvent) error {
+			// 客户端已断开：立即停止读取上游，不再写入
+			if clientGone(c) {
+				return client.ErrStopStream
+			}
+			if gate != nil {
+				if events, refused = gate.Feed(events); refused {
+					return client.ErrStopStream
 				}
-
-				textJSON, _ := json.Marshal(event.Delta)
-				_, _ = c.Writer.WriteString("event: content_block_delta\n")
-				_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"text_delta","text":%s}}`+"\n\n", blockIndex, string(textJSON))
-				flusher.Flush()
 			}
+			handleEvents(events)
+			// 命中停止序列或工具参数校验失败后剩余输出不再需要
+			if stopped || toolErr != nil {
+				return client.ErrStopStream
+			}
+			return nil
+		}, clientIP)
+		if clientGone(c) {
+			rlog.Info("[Anthropic] 流被客户端取消，已中止上游请求")
+			return
 		}
-	}, clientIP)
+		var events []client.CursorEvent
+		if gate != nil && !refused {
+			events, refused = gate.Close(nil)
+		}
+		if refused && err == nil {
+			rlog.Warn("[Anthropic] 检测到拒绝回答，追加引导语重新请求（第 %d/%d 次）", reprompts+1, limit)
+			cursorReq = repromptRequest(cursorReq)
+			continue
+		}
+		if refused {
+			events = gate.Release()
+		}
+		handleEvents(events)
+		break
+	}
+	upstreamLatency := time.Since(start)
 
+	// 软截止时间到达：以已生成的内容正常结束
+	truncated := false
+	if err != nil && softDeadlineReached(ctx) {
+		rlog.Info("[Anthropic] 软截止时间到达，返回部分内容")
+		truncated, err = true, nil
+	}
+	// 服务关闭：以已生成的内容正常结束，让客户端干净地关闭
+	if err != nil && shuttingDown(ctx) {
+		rlog.Warn("[Anthropic] 服务关闭，提前结束响应")
+		err = nil
+	}
 	if err != nil {
-		_, _ = c.Writer.WriteString("event: error\n")
-		_, _ = c.Writer.WriteString(`data: {"type":"error","error":{"message":"` + err.Error() + `"}}` + "\n\n")
-		flusher.Flush()
+		rlog.Error("[Anthropic] 上游请求失败: %v, 上游耗时=%v", err, upstreamLatency)
+		writeStreamError(out, err)
 		return
 	}
 
-	// 结束文本块
-	if textBlockStarted {
-		_, _ = c.Writer.WriteString("event: content_block_stop\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
-		flusher.Flush()
-		blockIndex++
+	// 未命中停止序列时下发保留的末尾文本（含预填充去重缓存的内容），再处理切分器中缓存的剩余内容
+	if !stopped {
+		var text string
+		text, stopped = stops.Feed(prefillTrim.Flush())
+		sendText(text)
 	}
+	if !stopped {
+		sendText(stops.Flush())
+	}
+	if splitter != nil {
+		handleSegments(splitter.Flush())
+	}
+	if toolErr != nil {
+		rlog.Error("[Anthropic] 工具调用参数无效: %v", toolErr)
+		writeStreamError(out, toolErr)
+		return
+	}
+	finishText()
+	finishThinking()
 
-	// 解析完整响应检查工具调用
 	responseText := fullResponse.String()
-	toolCalls, _ := toolify.ParseToolCalls(responseText)
-
-	// 发送工具调用
 	stopReason := "end_turn"
-	if len(toolCalls) > 0 {
+	if len(sentTools) > 0 {
 		stopReason = "tool_use"
-		for _, call := range toolCalls {
-			sendToolCall(call.Function.Name, call.Function.Arguments)
-		}
 	}
+	if truncatedTool {
+		stopReason = "max_tokens"
+	}
+
+	if truncated {
+		stopReason = "max_tokens"
+	}
+
+	var stopSequence *string
+	if stopped {
+		stopReason = "stop_sequence"
+		matched := stops.Matched()
+		stopSequence = &matched
+	}
+
+	// 按实际下发的文本与工具调用统计 output_tokens（与非流式共用 countOutputTokens）
+	outputBlocks := append([]ContentBlock{{Type: "thinking", Thinking: thinkingText.String()}, {Type: "text", Text: responseText}}, sentTools...)
+	outputTokens := countOutputTokens(outputBlocks, cursorReq.Model)
+	if stopReason == "end_turn" && reachedMaxTokens(outputTokens, cursorReq.MaxTokens) {
+		stopReason = "max_tokens"
+	}
+
+	writeSSE(out, "message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		// 与 message_start 一致带上 input_tokens，只读取最终 usage 的客户端也能拿到完整用量
+		"usage": Usage{InputTokens: inputTokens, OutputTokens: outputTokens},
+	})
+	writeSSE(out, "message_stop", gin.H{"type": "message_stop"})
+	out.Flush()
+
+	rlog.Info("[Anthropic] 请求完成: stop_reason=%s, 工具调用数=%d, 输出Token=%d, 上游耗时=%v", stopReason, len(sentTools), outputTokens, upstreamLatency)
+	metrics.ToolCalls(cursorReq.Model, len(sentTools))
+	recordTokens(c, cursorReq.Model, inputTokens, outputTokens)
+	markResponseComplete(c)
+}
+
+// writeStreamError 在流中发送 error 事件
+// error 事件是流的最后一个事件：调用方随后必须直接返回，不再发送 content_block_stop/message_delta/message_stop，
+// 避免客户端把失败的回合当作正常结束
+func writeStreamError(out *sseWriter, err error) {
+	writeSSE(out, "error", gin.H{
+		"type":  "error",
+		"error": gin.H{"type": streamErrorType(err), "message": err.Error()},
+	})
+	out.Flush()
+}
+
+// streamErrorType 按上游错误映射 Anthropic 错误类型
+func streamErrorType(err error) string {
+	var statusErr *client.StatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusServiceUnavailable:
+		return "overloaded_error"
+	case errors.Is(err, client.ErrPoolExhausted):
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// statusOverloaded Anthropic overloaded_error 使用的状态码
+const statusOverloaded = 529
 
-	_, _ = c.Writer.WriteString("event: message_delta\n")
-	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_delta","delta":{"stop_reason":"%s","stop_sequence":null},"usage":{"output_tokens":100}}`+"\n\n", stopReason)
-	_, _ = c.Writer.WriteString("event: message_stop\n")
-	_, _ = c.Writer.WriteString(`data: {"type":"message_stop"}` + "\n\n")
-	flusher.Flush()
+// upstreamErrorStatus 按上游错误选择非流式响应的状态码和错误类型，错误类型与流式响应的 streamErrorType 一致
+// 超过 timeout 时返回 504 timeout_error；overloadedStatus 为 overloaded_error 的状态码（Anthropic 529，OpenAI 503）
+func upstreamErrorStatus(ctx context.Context, err error, overloadedStatus int) (int, string) {
+	if requestTimedOut(ctx) {
+		return http.StatusGatewayTimeout, "timeout_error"
+	}
+	switch errType := streamErrorType(err); errType {
+	case "rate_limit_error":
+		return http.StatusTooManyRequests, errType
+	case "overloaded_error":
+		return overloadedStatus, errType
+	default:
+		return http.StatusInternalServerError, errType
+	}
 }
 
 // handleNonStream 处理非流式请求
-func handleNonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, clientIP string) {
-	svc := client.GetService()
-	result, err := svc.SendRequestWithIP(cursorReq, clientIP)
+func handleNonStream(ctx context.Context, c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, stopSequences []string, prefill string, thinking bool, clientIP string) {
+	rlog := requestLogger(c)
+	start := time.Now()
+	// 上游请求失败时按 model_fallbacks 依次尝试后备模型，后续重新请求使用实际提供响应的模型
+	result, cursorReq, err := sendWithFallback(ctx, c, cursorReq, clientIP)
+	// refusal.strategy=reprompt：拒绝回答时追加引导语重新请求（同样按 model_fallbacks 回退）
+	for reprompts, limit := 0, maxReprompts(); err == nil && reprompts < limit && detectRefusal(cursorResponseText(result)); reprompts++ {
+		rlog.Warn("[Anthropic] 检测到拒绝回答，追加引导语重新请求（第 %d/%d 次）", reprompts+1, limit)
+		result, cursorReq, err = sendWithFallback(ctx, c, repromptRequest(cursorReq), clientIP)
+	}
+	upstreamLatency := time.Since(start)
+	// 软截止时间到达：以已收到的部分内容正常返回
+	truncated := false
+	if err != nil && softDeadlineReached(ctx) {
+		rlog.Info("[Anthropic] 软截止时间到达，返回部分内容")
+		truncated, err = true, nil
+	}
+	// 服务关闭：以已生成的内容正常结束，让客户端干净地关闭
+	if err != nil && shuttingDown(ctx) {
+		rlog.Warn("[Anthropic] 服务关闭，提前结束响应")
+		err = nil
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
+		rlog.Error("[Anthropic] 上游请求失败: %v, 上游耗时=%v", err, upstreamLatency)
+		status, errType := upstreamErrorStatus(ctx, err, statusOverloaded)
+		abortWithError(c, status, errType, err.Error())
 		return
 	}
 
-	// 解析响应
-	var fullText strings.Builder
-	lines := strings.Split(result, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "data: ") {
-			continue
+	// 解析响应（上游返回 error 事件或非 SSE 内容时返回 502，而不是空的成功响应）
+	events := client.ParseEvents(result)
+	if !truncated {
+		if err := client.CheckResponse(result, events); err != nil {
+			rlog.Error("[Anthropic] 上游响应异常: %v, 上游耗时=%v", err, upstreamLatency)
+			abortWithError(c, http.StatusBadGateway, "api_error", err.Error())
+			return
 		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "" {
-			continue
-		}
-
-		var event CursorSSEEvent
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
-		}
-
-		if event.Type == "text-delta" && event.Delta != "" {
+	}
+	var fullText, thinkingText strings.Builder
+	for _, event := range events {
+		switch {
+		case event.Type == "text-delta" && event.Delta != "":
 			fullText.WriteString(event.Delta)
+		case event.Type == cursorReasoningDelta && event.Delta != "" && thinking:
+			thinkingText.WriteString(event.Delta)
 		}
 	}
 
-	responseText := fullText.String()
+	// 去掉开头重复的预填充文本，再截断到第一个停止序列（之后的内容不再解析工具调用）
+	responseText, matchedStop := truncateAtStopSequence(trimPrefill(fullText.String(), prefill), stopSequences)
 	var contentBlocks []ContentBlock
 	stopReason := "end_turn"
+	ids := newResponseIDs(c)
 
-	// 检测工具调用
+	// 思考块位于最前
+	if thinkingText.Len() > 0 {
+		signature := ""
+		contentBlocks = append(contentBlocks, ContentBlock{Type: "thinking", Thinking: thinkingText.String(), Signature: &signature})
+	}
+
+	// 检测工具调用：文本块和 tool_use 块按在响应中出现的顺序排列
 	if len(tools) > 0 {
-		toolCalls, cleanText := toolify.ParseToolCalls(responseText)
-		if len(toolCalls) > 0 {
-			stopReason = "tool_use"
-			if cleanText != "" {
-				contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: cleanText})
+		toolFilter := newToolCallFilter(rlog)
+		var blocks []ContentBlock
+		for _, seg := range toolParser().Segments(responseText) {
+			if len(seg.Calls) == 0 {
+				if text := strings.TrimSpace(applyOutputFilters(seg.Text)); text != "" {
+					blocks = append(blocks, ContentBlock{Type: "text", Text: text})
+				}
+				continue
 			}
-			for _, call := range toolCalls {
-				var args map[string]any
-				_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
-				contentBlocks = append(contentBlocks, ContentBlock{
+			for _, call := range toolFilter.filter(seg.Calls) {
+				args, err := resolveToolInput(tools, call.Function.Name, call.Function.Arguments)
+				if err != nil {
+					rlog.Error("[Anthropic] 工具调用参数无效: %v", err)
+					abortWithError(c, http.StatusBadGateway, "api_error", err.Error())
+					return
+				}
+				blocks = append(blocks, ContentBlock{
 					Type:  "tool_use",
-					ID:    "toolu_" + call.ID,
+					ID:    ids.toolUse(),
 					Name:  call.Function.Name,
 					Input: args,
 				})
 			}
+		}
+		if countToolUses(blocks) > 0 {
+			stopReason = "tool_use"
+			contentBlocks = append(contentBlocks, blocks...)
 		} else {
-			contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
+			contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: applyOutputFilters(responseText)})
 		}
 	} else {
-		contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
+		contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: applyOutputFilters(responseText)})
+	}
+
+	if truncated {
+		stopReason = "max_tokens"
+	}
+
+	var stopSequence *string
+	if matchedStop != "" {
+		stopReason = "stop_sequence"
+		stopSequence = &matchedStop
+	}
+
+	usage := Usage{
+		InputTokens:  countInputTokens(cursorReq),
+		OutputTokens: countOutputTokens(contentBlocks, cursorReq.Model),
+	}
+	if stopReason == "end_turn" && reachedMaxTokens(usage.OutputTokens, cursorReq.MaxTokens) {
+		stopReason = "max_tokens"
 	}
+	rlog.Info("[Anthropic] 请求完成: stop_reason=%s, 输出Token=%d, 上游耗时=%v", stopReason, usage.OutputTokens, upstreamLatency)
+	metrics.ToolCalls(cursorReq.Model, countToolUses(contentBlocks))
+	recordTokens(c, cursorReq.Model, usage.InputTokens, usage.OutputTokens)
 
+	markResponseComplete(c)
 	c.JSON(http.StatusOK, MessagesResponse{
-		ID:         "msg_" + generateID(),
-		Type:       "message",
-		Role:       "assistant",
-		Content:    contentBlocks,
-		Model:      model,
-		StopReason: stopReason,
-		Usage:      Usage{InputTokens: 100, OutputTokens: 100},
+		ID:           ids.message(),
+		Type:         "message",
+		Role:         "assistant",
+		Content:      contentBlocks,
+		Model:        model,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        usage,
 	})
 }
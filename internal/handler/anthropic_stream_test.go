@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/toolify"
+)
+
+var writeTool = []toolify.ToolDefinition{{
+	Name: "Write",
+	InputSchema: map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"file_path", "content"},
+	},
+}}
+
+// runStream 以桩上游执行 handleStream，返回解析后的事件
+func runStream(t *testing.T, stub *stubUpstream, tools []toolify.ToolDefinition, stopSequences []string) []sseEvent {
+	t.Helper()
+	useUpstream(t, stub)
+	c, w := newTestContext(http.MethodPost, "/v1/messages", "")
+	handleStream(context.Background(), c, client.CursorChatRequest{Model: "claude-4.5-sonnet"}, "claude-sonnet-4-5", tools, stopSequences, "", false, "")
+	return parseSSE(t, w.Body.String())
+}
+
+// toolInputs 按 content block 拼接 input_json_delta，返回各 tool_use 块的名称和输入
+func toolInputs(t *testing.T, events []sseEvent) (names []string, inputs []map[string]interface{}) {
+	t.Helper()
+	fragments := map[float64]*strings.Builder{}
+	var order []float64
+	for _, e := range events {
+		switch e.Name {
+		case "content_block_start":
+			block := e.Data["content_block"].(map[string]interface{})
+			if block["type"] == "tool_use" {
+				index := e.Data["index"].(float64)
+				names = append(names, block["name"].(string))
+				fragments[index] = &strings.Builder{}
+				order = append(order, index)
+			}
+		case "content_block_delta":
+			delta := e.Data["delta"].(map[string]interface{})
+			if delta["type"] == "input_json_delta" {
+				fragments[e.Data["index"].(float64)].WriteString(delta["partial_json"].(string))
+			}
+		}
+	}
+	for _, index := range order {
+		var input map[string]interface{}
+		if err := json.Unmarshal([]byte(fragments[index].String()), &input); err != nil {
+			t.Fatalf("tool input %q is not valid JSON: %v", fragments[index].String(), err)
+		}
+		inputs = append(inputs, input)
+	}
+	return names, inputs
+}
+
+// streamedText 拼接所有 text_delta
+func streamedText(events []sseEvent) string {
+	var b strings.Builder
+	for _, e := range eventsNamed(events, "content_block_delta") {
+		delta := e.Data["delta"].(map[string]interface{})
+		if delta["type"] == "text_delta" {
+			b.WriteString(delta["text"].(string))
+		}
+	}
+	return b.String()
+}
+
+func TestHandleStreamTruncatedToolCall(t *testing.T) {
+	stub := &stubUpstream{batches: [][]client.CursorEvent{
+		textEvents("Saving the file.\n", `<vm_write path="notes.txt">`),
+		textEvents("first line\nsecond li"),
+	}}
+	events := runStream(t, stub, writeTool, nil)
+
+	names, inputs := toolInputs(t, events)
+	if len(names) != 1 || names[0] != "Write" {
+		t.Fatalf("tool_use blocks = %v, want [Write]", names)
+	}
+	if inputs[0]["file_path"] != "notes.txt" || inputs[0]["content"] != "first line\nsecond li" {
+		t.Errorf("partial input = %v", inputs[0])
+	}
+	if got := stopReason(t, events); got != "max_tokens" {
+		t.Errorf("stop_reason = %q, want max_tokens", got)
+	}
+	if len(eventsNamed(events, "message_stop")) != 1 {
+		t.Error("missing message_stop")
+	}
+}
+
+func TestHandleStreamTruncatedOpenTag(t *testing.T) {
+	// 流结束在起始标签中途：无法识别工具，按文本下发而不是 panic
+	stub := &stubUpstream{batches: [][]client.CursorEvent{
+		textEvents("Saving the file.\n", `<vm_write path="no`),
+	}}
+	events := runStream(t, stub, writeTool, nil)
+
+	if names, _ := toolInputs(t, events); len(names) != 0 {
+		t.Fatalf("tool_use blocks = %v, want none", names)
+	}
+	if text := streamedText(events); !strings.Contains(text, "Saving the file.") {
+		t.Errorf("text = %q", text)
+	}
+	if len(eventsNamed(events, "message_stop")) != 1 {
+		t.Error("missing message_stop")
+	}
+}
+
+func TestHandleStreamToolInputEscaping(t *testing.T) {
+	content := "line 1\nsay \"hi\" \U0001F680 C:\\temp\\new \x01\ttab"
+	stub := &stubUpstream{batches: [][]client.CursorEvent{
+		textEvents(`<vm_write path="dir/a b.txt">` + content + `</vm_write>`),
+	}}
+	events := runStream(t, stub, writeTool, nil)
+
+	names, inputs := toolInputs(t, events)
+	if len(names) != 1 {
+		t.Fatalf("tool_use blocks = %v, want 1", names)
+	}
+	if inputs[0]["content"] != content || inputs[0]["file_path"] != "dir/a b.txt" {
+		t.Errorf("input = %q, want content %q", inputs[0], content)
+	}
+	if got := stopReason(t, events); got != "tool_use" {
+		t.Errorf("stop_reason = %q, want tool_use", got)
+	}
+}
+
+func TestHandleStreamMidStreamError(t *testing.T) {
+	stub := &stubUpstream{
+		batches: [][]client.CursorEvent{textEvents("Partial ", "answer")},
+		err:     errors.New("upstream connection reset"),
+	}
+	events := runStream(t, stub, nil, nil)
+
+	last := events[len(events)-1]
+	if last.Name != "error" {
+		t.Fatalf("last event = %q, want error", last.Name)
+	}
+	if errBody := last.Data["error"].(map[string]interface{}); errBody["type"] != "api_error" {
+		t.Errorf("error = %v, want api_error", errBody)
+	}
+	for _, name := range []string{"message_delta", "message_stop"} {
+		if len(eventsNamed(events, name)) != 0 {
+			t.Errorf("got %s after the error, want the stream to end at the error event", name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cursor2api/internal/client"
+)
+
+// assertAnthropicError 检查响应是 Anthropic 格式的错误
+func assertAnthropicError(t *testing.T, body map[string]interface{}, wantType string) {
+	t.Helper()
+	errBody, _ := body["error"].(map[string]interface{})
+	if body["type"] != "error" || errBody["type"] != wantType || errBody["message"] == "" {
+		t.Errorf("body = %v, want Anthropic %s envelope", body, wantType)
+	}
+}
+
+func TestMessagesInvalidJSON(t *testing.T) {
+	c, w := newTestContext(http.MethodPost, "/v1/messages", `{"model": `)
+	Messages(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	assertAnthropicError(t, decodeJSON(t, w), "invalid_request_error")
+}
+
+func TestHandleNonStreamUpstreamError(t *testing.T) {
+	status, body := runNonStream(t, &stubUpstream{err: errors.New("connection reset")}, nil, nil, "")
+	if status != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", status)
+	}
+	assertAnthropicError(t, body, "api_error")
+}
+
+// postMessages 以桩上游执行 Messages，返回响应
+func postMessages(t *testing.T, stub *stubUpstream, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	useUpstream(t, stub)
+	c, w := newTestContext(http.MethodPost, "/v1/messages", body)
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	Messages(c)
+	return w
+}
+
+func TestMessagesStreamFromAcceptHeader(t *testing.T) {
+	sse := map[string]string{"Accept": "text/event-stream"}
+	tests := []struct {
+		name       string
+		body       string
+		wantStream bool
+	}{
+		{name: "stream unset with SSE accept", body: `{"model": "claude-sonnet-4-5", "max_tokens": 64, "messages": [{"role": "user", "content": "hi"}]}`, wantStream: true},
+		{name: "explicit stream false wins", body: `{"model": "claude-sonnet-4-5", "max_tokens": 64, "stream": false, "messages": [{"role": "user", "content": "hi"}]}`, wantStream: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubUpstream{body: sseBody("hello"), batches: [][]client.CursorEvent{textEvents("hello")}}
+			w := postMessages(t, stub, tt.body, sse)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			isStream := strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+			if isStream != tt.wantStream {
+				t.Fatalf("Content-Type = %q, want stream = %v", w.Header().Get("Content-Type"), tt.wantStream)
+			}
+			if tt.wantStream {
+				if len(eventsNamed(parseSSE(t, w.Body.String()), "message_stop")) != 1 {
+					t.Error("missing message_stop")
+				}
+			} else if decodeJSON(t, w)["type"] != "message" {
+				t.Errorf("body = %s, want a message object", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleNonStreamJSONErrorBody(t *testing.T) {
+	stub := &stubUpstream{body: `{"error": {"message": "Model overloaded"}}`}
+	status, body := runNonStream(t, stub, nil, nil, "")
+	if status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", status)
+	}
+	assertAnthropicError(t, body, "api_error")
+	if msg := body["error"].(map[string]interface{})["message"]; !strings.Contains(msg.(string), "Model overloaded") {
+		t.Errorf("message = %q, want the upstream error", msg)
+	}
+}
+
+func TestHandleNonStreamUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantType   string
+	}{
+		{name: "rate limited", err: &client.StatusError{StatusCode: http.StatusTooManyRequests}, wantStatus: http.StatusTooManyRequests, wantType: "rate_limit_error"},
+		{name: "unavailable", err: &client.StatusError{StatusCode: http.StatusServiceUnavailable}, wantStatus: statusOverloaded, wantType: "overloaded_error"},
+		{name: "pool exhausted", err: fmt.Errorf("%w: no idle session", client.ErrPoolExhausted), wantStatus: statusOverloaded, wantType: "overloaded_error"},
+		{name: "other", err: &client.StatusError{StatusCode: http.StatusBadGateway}, wantStatus: http.StatusInternalServerError, wantType: "api_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := runNonStream(t, &stubUpstream{err: tt.err}, nil, nil, "")
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			assertAnthropicError(t, body, tt.wantType)
+		})
+	}
+}
+
+func TestHandleNonStreamRequestTimeout(t *testing.T) {
+	useUpstream(t, &stubUpstream{wait: true})
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 10*time.Millisecond, errRequestTimeout)
+	defer cancel()
+	c, w := newTestContext(http.MethodPost, "/v1/messages", "")
+	handleNonStream(ctx, c, client.CursorChatRequest{Model: "claude-4.5-sonnet"}, "claude-sonnet-4-5", nil, nil, "", false, "")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", w.Code)
+	}
+	assertAnthropicError(t, decodeJSON(t, w), "timeout_error")
+}
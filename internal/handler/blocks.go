@@ -0,0 +1,193 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// unsupportedBlocksReject 遇到无法转发的内容块时拒绝请求（默认 stub 以占位文本代替）
+const unsupportedBlocksReject = "reject"
+
+// document_blocks 的取值：inline（默认）内联可提取的文本，stub 一律以占位文本代替，reject 拒绝请求
+const (
+	documentBlocksInline = "inline"
+	documentBlocksReject = "reject"
+)
+
+// supportedBlockTypes 可以转换为 Cursor 文本消息的内容块类型
+var supportedBlockTypes = map[string]bool{
+	"text":        true,
+	"tool_use":    true,
+	"tool_result": true,
+	// thinking 以文本形式转发，redacted_thinking 无法转发直接丢弃
+	"thinking":          true,
+	"redacted_thinking": true,
+}
+
+// textBlockContent 提取文本内容块中的文本
+// 兼容 {"type":"text","text":...}、缺少 type 的 {"text":...} 以及直接写成字符串的元素；
+// cache_control 等其余字段忽略
+func textBlockContent(item interface{}) (string, bool) {
+	switch v := item.(type) {
+	case string:
+		return v, true
+	case map[string]interface{}:
+		if blockType, ok := v["type"]; ok && blockType != "text" {
+			return "", false
+		}
+		text, ok := v["text"].(string)
+		return text, ok
+	default:
+		return "", false
+	}
+}
+
+// blockCacheControl 读取内容块上的 cache_control 标记，没有时返回 nil
+func blockCacheControl(block map[string]interface{}) *client.CacheControl {
+	cc, ok := block["cache_control"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ccType, _ := cc["type"].(string)
+	return &client.CacheControl{Type: ccType}
+}
+
+// validateContentBlocks 在 unsupported_blocks=reject 时检查消息中是否含有无法转发的内容块，
+// document_blocks=reject 时检查是否含有文档内容块
+func validateContentBlocks(messages []Message) error {
+	cfg := config.Get()
+	rejectUnsupported := cfg.UnsupportedBlocks == unsupportedBlocksReject
+	rejectDocuments := cfg.DocumentBlocks == documentBlocksReject
+	if !rejectUnsupported && !rejectDocuments {
+		return nil
+	}
+	for i, msg := range messages {
+		content, ok := msg.Content.([]interface{})
+		if !ok {
+			continue
+		}
+		for j, item := range content {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			blockType, _ := block["type"].(string)
+			if blockType == "document" {
+				if rejectDocuments {
+					return fmt.Errorf("messages.%d.content.%d: document blocks are not supported by this proxy", i, j)
+				}
+				continue
+			}
+			if rejectUnsupported && !supportedBlockTypes[blockType] {
+				return fmt.Errorf("messages.%d.content.%d: content block type %q is not supported by this proxy", i, j, blockType)
+			}
+		}
+	}
+	return nil
+}
+
+// describeUnsupportedBlock 为无法转发的内容块生成占位文本，让模型知道此处有被省略的内容
+// Cursor 的消息 part 只支持文本，图片等内容无法转发
+func describeUnsupportedBlock(block map[string]interface{}) string {
+	blockType, _ := block["type"].(string)
+	if blockType != "image" {
+		return fmt.Sprintf("[%s block omitted]", blockType)
+	}
+
+	source, _ := block["source"].(map[string]interface{})
+	sourceType, _ := source["type"].(string)
+	switch sourceType {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		return fmt.Sprintf("[image omitted: base64 %s]", strings.TrimPrefix(mediaType, "image/"))
+	case "url":
+		url, _ := source["url"].(string)
+		return fmt.Sprintf("[image omitted: %s]", url)
+	default:
+		return "[image omitted]"
+	}
+}
+
+// documentBlockText 将文档内容块转换为消息文本
+// document_blocks=inline 时纯文本文档连同标题内联，PDF 等无法提取文本的文档以占位文本代替（reject 时已在入口拒绝）
+func documentBlockText(block map[string]interface{}) string {
+	title, _ := block["title"].(string)
+	source, _ := block["source"].(map[string]interface{})
+	if config.Get().DocumentBlocks != documentBlocksInline {
+		return describeDocument(source, title)
+	}
+	text, ok := documentSourceText(source)
+	if !ok {
+		return describeDocument(source, title)
+	}
+	if title == "" {
+		return "[document]\n" + text
+	}
+	return fmt.Sprintf("[document: %s]\n%s", title, text)
+}
+
+// documentSourceText 提取文档来源中的纯文本
+// 支持 text（data 为文本）、content（文本内容块数组）以及 base64 编码的 text/* 文档
+func documentSourceText(source map[string]interface{}) (string, bool) {
+	sourceType, _ := source["type"].(string)
+	switch sourceType {
+	case "text":
+		data, ok := source["data"].(string)
+		return data, ok
+	case "content":
+		switch v := source["content"].(type) {
+		case string:
+			return v, true
+		case []interface{}:
+			var texts []string
+			for _, item := range v {
+				if text, ok := textBlockContent(item); ok {
+					texts = append(texts, text)
+				}
+			}
+			return strings.Join(texts, "\n"), len(texts) > 0
+		}
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		if !strings.HasPrefix(mediaType, "text/") {
+			return "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", false
+		}
+		return string(decoded), true
+	}
+	return "", false
+}
+
+// describeDocument 为无法内联的文档生成占位文本，如 [document omitted: pdf "report.pdf"]
+func describeDocument(source map[string]interface{}, title string) string {
+	var desc string
+	sourceType, _ := source["type"].(string)
+	switch sourceType {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		desc = strings.TrimPrefix(mediaType, "application/")
+	case "text", "content":
+		desc = "text"
+	case "url":
+		desc, _ = source["url"].(string)
+	case "file":
+		fileID, _ := source["file_id"].(string)
+		desc = strings.TrimSpace("file " + fileID)
+	}
+	if title != "" {
+		desc = strings.TrimSpace(fmt.Sprintf("%s %q", desc, title))
+	}
+	if desc == "" {
+		return "[document omitted]"
+	}
+	return fmt.Sprintf("[document omitted: %s]", desc)
+}
@@ -0,0 +1,183 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var (
+	captureWriter     *lumberjack.Logger
+	captureWriterOnce sync.Once
+)
+
+// captureFile 返回抽样记录文件的轮转写入器
+func captureFile() *lumberjack.Logger {
+	captureWriterOnce.Do(func() {
+		cfg := config.Get().Capture
+		captureWriter = &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+		}
+	})
+	return captureWriter
+}
+
+// exchangeCapture 一次被抽中的请求
+type exchangeCapture struct {
+	c        *gin.Context
+	recorder *middleware.RecordingWriter
+	start    time.Time
+}
+
+// captureRecord 写入记录文件的一行
+type captureRecord struct {
+	Time          string      `json:"time"`
+	RequestID     string      `json:"request_id"`
+	Path          string      `json:"path"`
+	DurationMs    int64       `json:"duration_ms"`
+	Status        int         `json:"status"`
+	Redacted      bool        `json:"redacted"`
+	Request       interface{} `json:"request"`
+	CursorRequest interface{} `json:"cursor_request"`
+	Response      interface{} `json:"response"`
+}
+
+// sampleCapture 按 capture.rate 抽样；被抽中时接管响应写入器并返回 *exchangeCapture，否则返回 nil
+// 必须在写出响应之前调用
+func sampleCapture(c *gin.Context) *exchangeCapture {
+	rate := config.Get().Capture.Rate
+	if rate <= 0 || rand.Float64() >= rate {
+		return nil
+	}
+	recorder := middleware.NewRecordingWriter(c.Writer)
+	c.Writer = recorder
+	return &exchangeCapture{c: c, recorder: recorder, start: time.Now()}
+}
+
+// write 请求处理结束后写出记录：客户端请求、转换后的 Cursor 请求和最终响应
+func (e *exchangeCapture) write(request interface{}, cursorReq *client.CursorChatRequest) {
+	redact := config.Get().Capture.Redact
+	record := captureRecord{
+		Time:          e.start.Format(time.RFC3339),
+		RequestID:     e.c.GetString(middleware.RequestIDKey),
+		Path:          e.c.Request.URL.Path,
+		DurationMs:    time.Since(e.start).Milliseconds(),
+		Status:        e.recorder.Status(),
+		Redacted:      redact,
+		Request:       captureJSON(request, redact),
+		CursorRequest: captureJSON(cursorReq, redact),
+		Response:      captureResponse(string(e.recorder.Body()), e.recorder.Header().Get("Content-Type"), redact),
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		requestLogger(e.c).Warn("[Capture] 序列化记录失败: %v", err)
+		return
+	}
+	if _, err := captureFile().Write(append(line, '\n')); err != nil {
+		requestLogger(e.c).Warn("[Capture] 写入记录失败: %v", err)
+	}
+}
+
+// captureJSON 将值转换为通用的 JSON 结构，redact 时隐藏其中的内容
+func captureJSON(v interface{}, redact bool) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil
+	}
+	if redact {
+		generic = redactContent("", generic, false)
+	}
+	return generic
+}
+
+// captureResponse 解析记录的响应：JSON 响应按结构保存，SSE 响应保存为事件数组，其余保存为字符串
+func captureResponse(body, contentType string, redact bool) interface{} {
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		var events []interface{}
+		for _, line := range strings.Split(body, "\n") {
+			data, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), "data: ")
+			if !ok {
+				continue
+			}
+			var event interface{}
+			if json.Unmarshal([]byte(data), &event) != nil {
+				event = data
+			}
+			events = append(events, event)
+		}
+		if redact {
+			return redactContent("", events, false)
+		}
+		return events
+	}
+	var generic interface{}
+	if json.Unmarshal([]byte(body), &generic) == nil {
+		if redact {
+			return redactContent("", generic, false)
+		}
+		return generic
+	}
+	if redact {
+		return redactedText(body)
+	}
+	return body
+}
+
+// redactedKeys 其字符串值属于消息内容、需要隐藏的字段（请求、Cursor 请求和响应中的文本、思考、工具参数等）
+var redactedKeys = map[string]bool{
+	"text":         true,
+	"thinking":     true,
+	"content":      true,
+	"system":       true,
+	"data":         true,
+	"partial_json": true,
+	"arguments":    true,
+	"user_id":      true,
+	"user":         true,
+}
+
+// redactContent 递归隐藏 JSON 结构中的内容：redactedKeys 字段的字符串以及工具输入（input 对象）中的所有字符串
+// 替换为长度占位，type、role、model 等结构字段保留
+func redactContent(key string, v interface{}, inToolInput bool) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = redactContent(k, item, inToolInput || key == "input")
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactContent(key, item, inToolInput)
+		}
+		return value
+	case string:
+		if redactedKeys[key] || inToolInput {
+			return redactedText(value)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// redactedText 内容的长度占位
+func redactedText(s string) string {
+	return fmt.Sprintf("[redacted: %d bytes]", len(s))
+}
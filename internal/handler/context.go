@@ -0,0 +1,106 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"cursor2api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errSoftDeadline 软截止时间到达（返回已生成的部分内容，而不是报错）
+var errSoftDeadline = errors.New("soft deadline reached")
+
+// errRequestTimeout 超过配置的最长处理时间（timeout）
+var errRequestTimeout = errors.New("request timeout")
+
+// errShuttingDown 服务关闭，宽限期内未完成的请求被中止
+var errShuttingDown = errors.New("server shutting down")
+
+// drainCtx 服务关闭宽限期结束时取消，进行中的上游请求随之中止
+var drainCtx, drainCancel = context.WithCancel(context.Background())
+
+// Drain 中止所有进行中的上游请求，各请求以已生成的内容正常结束（stop_reason=end_turn）
+// 在优雅关闭的宽限期结束后调用
+func Drain() {
+	drainCancel()
+}
+
+// upstreamTimeoutHeader 按请求覆盖 timeout 的请求头（秒）
+const upstreamTimeoutHeader = "X-Upstream-Timeout"
+
+// requestTimeout 返回本次请求的最长处理时间（秒），0 为不限制
+// 请求头 X-Upstream-Timeout 覆盖配置的 timeout，超过 max_timeout 时截断；max_timeout 为 0 时忽略该请求头
+func requestTimeout(c *gin.Context, logPrefix string) int {
+	cfg := config.Get()
+	v := c.GetHeader(upstreamTimeoutHeader)
+	if v == "" || cfg.MaxTimeout <= 0 {
+		return cfg.Timeout
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		requestLogger(c).Warn("%s 忽略无效的 %s: %s", logPrefix, upstreamTimeoutHeader, v)
+		return cfg.Timeout
+	}
+	if seconds > cfg.MaxTimeout {
+		requestLogger(c).Warn("%s %s=%ds 超过 max_timeout，按 %ds 处理", logPrefix, upstreamTimeoutHeader, seconds, cfg.MaxTimeout)
+		return cfg.MaxTimeout
+	}
+	requestLogger(c).Debug("%s %s: %ds", logPrefix, upstreamTimeoutHeader, seconds)
+	return seconds
+}
+
+// requestContext 为上游请求创建 context
+// 继承 gin 请求的 context：客户端断开时取消上游请求；配置 timeout（或请求头 X-Upstream-Timeout）为单个请求（含流式）的最长处理时间
+// 请求头 x-soft-deadline-ms 设置软截止时间：到期后中止上游，并以已生成的内容正常结束响应
+// logPrefix 为日志前缀（如 "[Anthropic]"、"[OpenAI]"）
+func requestContext(c *gin.Context, logPrefix string) (context.Context, context.CancelFunc) {
+	ctx, cancel := c.Request.Context(), context.CancelFunc(func() {})
+	if timeout := requestTimeout(c, logPrefix); timeout > 0 {
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(timeout)*time.Second, errRequestTimeout)
+	}
+
+	// 服务关闭宽限期结束时中止
+	drainingCtx, drainingCancel := context.WithCancelCause(ctx)
+	stopDrain := context.AfterFunc(drainCtx, func() { drainingCancel(errShuttingDown) })
+	ctx, timeoutCancel := drainingCtx, cancel
+	cancel = func() {
+		stopDrain()
+		drainingCancel(nil)
+		timeoutCancel()
+	}
+
+	if v := c.GetHeader("x-soft-deadline-ms"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			requestLogger(c).Debug("%s 软截止时间: %dms", logPrefix, ms)
+			softCtx, softCancel := context.WithTimeoutCause(ctx, time.Duration(ms)*time.Millisecond, errSoftDeadline)
+			return softCtx, func() { softCancel(); cancel() }
+		}
+		requestLogger(c).Warn("%s 忽略无效的 x-soft-deadline-ms: %s", logPrefix, v)
+	}
+	return ctx, cancel
+}
+
+// clientGone 判断客户端是否已断开连接
+func clientGone(c *gin.Context) bool {
+	return c.Request.Context().Err() != nil
+}
+
+// shuttingDown 判断上游请求是否因服务关闭而中止
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errShuttingDown)
+}
+
+// requestTimedOut 判断上游请求是否因超过 timeout（或 X-Upstream-Timeout）而中止
+func requestTimedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRequestTimeout)
+}
+
+// softDeadlineReached 判断上游请求是否因软截止时间而中止
+func softDeadlineReached(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errSoftDeadline)
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"cursor2api/internal/client"
+)
+
+const softDeadlineRequest = `{"model": "claude-sonnet-4-5", "max_tokens": 1024, "stream": %s, "messages": [{"role": "user", "content": "write a long essay"}]}`
+
+func TestSoftDeadlineStreamReturnsPartialContent(t *testing.T) {
+	stub := &stubUpstream{batches: [][]client.CursorEvent{textEvents("The first ", "paragraph.")}, wait: true}
+	start := time.Now()
+	w := postMessages(t, stub, fmt.Sprintf(softDeadlineRequest, "true"), map[string]string{"x-soft-deadline-ms": "100"})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request took %v, want it to end at the soft deadline", elapsed)
+	}
+
+	events := parseSSE(t, w.Body.String())
+	if len(eventsNamed(events, "error")) != 0 {
+		t.Fatalf("unexpected error event: %s", w.Body.String())
+	}
+	if text := streamedText(events); text != "The first paragraph." {
+		t.Errorf("text = %q, want the partial content", text)
+	}
+	if got := stopReason(t, events); got != "max_tokens" {
+		t.Errorf("stop_reason = %q, want max_tokens", got)
+	}
+	if len(eventsNamed(events, "message_stop")) != 1 {
+		t.Error("missing message_stop")
+	}
+}
+
+func TestSoftDeadlineNonStreamReturnsPartialContent(t *testing.T) {
+	stub := &stubUpstream{body: sseBody("The first ", "paragraph."), wait: true}
+	w := postMessages(t, stub, fmt.Sprintf(softDeadlineRequest, "false"), map[string]string{"x-soft-deadline-ms": "100"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	body := decodeJSON(t, w)
+	if body["stop_reason"] != "max_tokens" {
+		t.Errorf("stop_reason = %v, want max_tokens", body["stop_reason"])
+	}
+	content := body["content"].([]interface{})
+	if len(content) != 1 || content[0].(map[string]interface{})["text"] != "The first paragraph." {
+		t.Errorf("content = %v, want the partial text", content)
+	}
+}
@@ -0,0 +1,93 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"cursor2api/internal/client"
+	"cursor2api/internal/toolify"
+)
+
+// Option 请求转换选项（见 ConvertRequest）
+type Option func(*convertOptions)
+
+// convertOptions 请求转换依赖的可替换部分，默认值与 HTTP 处理器的行为一致
+type convertOptions struct {
+	// mapModel 将客户端模型名映射为 Cursor 模型
+	mapModel func(model string) (string, error)
+	// system 对组装好的系统提示词做最终处理（引导语、前缀/后缀）
+	system func(sysText string) string
+	// toolPrompt 生成注入到第一条用户消息前的工具提示词
+	toolPrompt func(tools []toolify.ToolDefinition, choice *toolify.ToolChoice) string
+	// trace 不为空时记录转换过程中组装的系统提示词和工具提示词（/debug/convert 使用）
+	trace *conversionTrace
+}
+
+// conversionTrace 转换过程中组装的中间结果
+type conversionTrace struct {
+	System     string
+	ToolPrompt string
+}
+
+// newConvertOptions 按请求生成默认选项（读取全局配置），再应用 opts
+func newConvertOptions(req MessagesRequest, opts []Option) *convertOptions {
+	o := &convertOptions{
+		mapModel: lookupModel,
+		system: func(sysText string) string {
+			return applyRefusalFraming(applySystemAffix(sysText, req.noSystemAffix))
+		},
+		toolPrompt: defaultToolPrompt,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithModelMapper 指定模型映射（默认使用 model_mapping 配置，strict_models 开启时未知模型返回错误）
+func WithModelMapper(mapModel func(model string) (string, error)) Option {
+	return func(o *convertOptions) {
+		o.mapModel = mapModel
+	}
+}
+
+// WithSystemPrefix 指定加在系统提示词之前的前缀，替代 refusal_framing 和 system_affix 配置；为空时系统提示词原样发送
+func WithSystemPrefix(prefix string) Option {
+	return func(o *convertOptions) {
+		o.system = func(sysText string) string {
+			switch {
+			case prefix == "":
+				return sysText
+			case sysText == "":
+				return prefix
+			}
+			return prefix + "\n\n" + sysText
+		}
+	}
+}
+
+// WithToolPrompt 指定工具提示词生成函数（默认为 toolify.GenerateToolPrompt 加 tool_choice 指令），返回空字符串时不注入
+func WithToolPrompt(generate func(tools []toolify.ToolDefinition, choice *toolify.ToolChoice) string) Option {
+	return func(o *convertOptions) {
+		o.toolPrompt = generate
+	}
+}
+
+// defaultToolPrompt 默认的工具提示词：工具定义加 tool_choice 对应的指令
+func defaultToolPrompt(tools []toolify.ToolDefinition, choice *toolify.ToolChoice) string {
+	prompt := toolify.GenerateToolPrompt(tools)
+	if instruction := toolify.ToolChoiceInstruction(choice); instruction != "" {
+		prompt += instruction + "\n"
+	}
+	return prompt
+}
+
+// ConvertRequest 将 Anthropic Messages 请求转换为 Cursor 请求，不依赖 HTTP 上下文
+// 模型映射、系统提示词前缀和工具提示词可通过 opts 替换；其余行为（system_prompt_modes、cursor_context、
+// 采样参数、tool_result 防护等）仍按全局配置处理。模型映射失败时返回错误
+func ConvertRequest(req MessagesRequest, opts ...Option) (client.CursorChatRequest, error) {
+	o := newConvertOptions(req, opts)
+	cursorModel, err := o.mapModel(req.Model)
+	if err != nil {
+		return client.CursorChatRequest{}, err
+	}
+	return convert(req, cursorModel, o), nil
+}
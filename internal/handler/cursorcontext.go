@@ -0,0 +1,27 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// cursorContext 确定发送给 Cursor 的上下文
+// 请求中的 cursor_context 优先（显式传入空数组表示不发送）；未设置时使用 cursor_context 配置，均未设置时不发送
+func cursorContext(override []client.CursorContext) []client.CursorContext {
+	if override != nil {
+		if len(override) == 0 {
+			return nil
+		}
+		return override
+	}
+	configured := config.Get().CursorContext
+	if len(configured) == 0 {
+		return nil
+	}
+	contexts := make([]client.CursorContext, len(configured))
+	for i, ctx := range configured {
+		contexts[i] = client.CursorContext{Type: ctx.Type, Content: ctx.Content, FilePath: ctx.FilePath}
+	}
+	return contexts
+}
@@ -0,0 +1,90 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"cursor2api/internal/client"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DebugConvertResponse /debug/convert 的响应
+type DebugConvertResponse struct {
+	// Model 请求中的模型名
+	Model string `json:"model"`
+	// CursorModel 映射后的 Cursor 模型
+	CursorModel string `json:"cursor_model"`
+	// System 组装后的系统提示词（含 refusal_framing、system_affix），按 system_prompt_modes 作为 system 消息发送或并入第一条用户消息
+	System string `json:"system"`
+	// ToolPrompt 注入到第一条用户消息前的工具提示词（未注入时为空）
+	ToolPrompt string `json:"tool_prompt"`
+	// Messages 每条 Cursor 消息的 part 以换行拼接后的文本
+	Messages []DebugMessage `json:"messages"`
+	// Request 将发送给 Cursor 的完整请求
+	Request client.CursorChatRequest `json:"request"`
+}
+
+// DebugMessage 拼接后的 Cursor 消息
+type DebugMessage struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+}
+
+// DebugConvert 接受 Messages API 请求，返回转换后的 Cursor 请求，不请求上游（debug_endpoints 开启时注册）
+// 校验、模型映射、max_tokens 和输入过滤与 /v1/messages 一致，便于排查转换问题
+func DebugConvert(c *gin.Context) {
+	var req MessagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		status, errType := bindErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
+	}
+	req.noSystemAffix = skipSystemAffix(c)
+
+	if err := validateMessageLimits(messageContents(req.Messages)); err != nil {
+		status, errType := validationErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
+	}
+	if err := validateUserContent(req.Messages); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	cursorModel, err := resolveCursorModel(c, req.Model)
+	if err != nil {
+		status, errType := modelErrorStatus(err)
+		abortWithError(c, status, errType, err.Error())
+		return
+	}
+	if req.MaxTokens, err = resolveMaxTokens(cursorModel, req.MaxTokens); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	cursorReq, trace := traceConvertToCursor(req, cursorModel)
+	if ferr := filterInput(&cursorReq); ferr != nil {
+		abortWithError(c, ferr.Status, ferr.Type, ferr.Message)
+		return
+	}
+
+	messages := make([]DebugMessage, len(cursorReq.Messages))
+	for i, msg := range cursorReq.Messages {
+		texts := make([]string, len(msg.Parts))
+		for j, part := range msg.Parts {
+			texts[j] = part.Text
+		}
+		messages[i] = DebugMessage{Role: msg.Role, Text: strings.Join(texts, "\n")}
+	}
+
+	c.JSON(http.StatusOK, DebugConvertResponse{
+		Model:       req.Model,
+		CursorModel: cursorModel,
+		System:      trace.System,
+		ToolPrompt:  trace.ToolPrompt,
+		Messages:    messages,
+		Request:     cursorReq,
+	})
+}
@@ -0,0 +1,94 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// servedModelHeader 响应头：实际提供响应的 Cursor 模型（发生模型回退时与请求映射的模型不同）
+const servedModelHeader = "X-Served-Model"
+
+// upstreamSender 向上游 Cursor 发送请求，由 *client.Service 实现
+type upstreamSender interface {
+	SendRequestWithIP(ctx context.Context, req client.CursorChatRequest, clientIP string) (string, error)
+	SendStreamRequestWithIP(ctx context.Context, req client.CursorChatRequest, onEvents func(events []client.CursorEvent) error, clientIP string) error
+}
+
+// upstream 返回发送请求使用的上游服务（测试中替换为桩实现）
+var upstream = func() upstreamSender { return client.GetService() }
+
+// fallbackModels 返回 Cursor 模型在 model_fallbacks 中配置的后备模型（按顺序，键忽略大小写）
+// 跳过与主模型相同、重复以及当前 API Key 不允许使用的模型
+func fallbackModels(c *gin.Context, model string) []string {
+	var chain []string
+	for key, models := range config.Get().ModelFallbacks {
+		if strings.EqualFold(key, model) {
+			chain = models
+			break
+		}
+	}
+	seen := map[string]bool{strings.ToLower(model): true}
+	var result []string
+	for _, m := range chain {
+		if m == "" || seen[strings.ToLower(m)] || checkModelAllowed(c, m) != nil {
+			continue
+		}
+		seen[strings.ToLower(m)] = true
+		result = append(result, m)
+	}
+	return result
+}
+
+// sendWithFallback 发送非流式请求，上游请求失败或返回异常响应时依次使用后备模型重新请求
+// 返回最后一次请求的响应和请求（Model 为实际使用的模型），并在响应头中记录实际使用的模型；
+// ctx 已取消或超时时不再回退
+func sendWithFallback(ctx context.Context, c *gin.Context, req client.CursorChatRequest, clientIP string) (string, client.CursorChatRequest, error) {
+	rlog := requestLogger(c)
+	svc := upstream()
+	result, err := svc.SendRequestWithIP(ctx, req, clientIP)
+	for _, model := range fallbackModels(c, req.Model) {
+		failure := err
+		if failure == nil {
+			failure = client.CheckResponse(result, client.ParseEvents(result))
+		}
+		if failure == nil || ctx.Err() != nil {
+			break
+		}
+		rlog.Warn("模型 %s 请求失败: %v，回退到 %s", req.Model, failure, model)
+		req.Model = model
+		result, err = svc.SendRequestWithIP(ctx, req, clientIP)
+	}
+	c.Header(servedModelHeader, req.Model)
+	return result, req, err
+}
+
+// streamWithFallback 发送流式请求，上游在返回任何事件之前失败时依次使用后备模型重新请求
+// 已向 onEvents 交付过事件（内容可能已发送给客户端）后不再回退，直接返回错误；
+// 返回最后一次请求（Model 为实际使用的模型）
+func streamWithFallback(ctx context.Context, c *gin.Context, req client.CursorChatRequest, onEvents func(events []client.CursorEvent) error, clientIP string) (client.CursorChatRequest, error) {
+	rlog := requestLogger(c)
+	svc := upstream()
+	delivered := false
+	send := func() error {
+		return svc.SendStreamRequestWithIP(ctx, req, func(events []client.CursorEvent) error {
+			delivered = true
+			return onEvents(events)
+		}, clientIP)
+	}
+	err := send()
+	for _, model := range fallbackModels(c, req.Model) {
+		if err == nil || delivered || ctx.Err() != nil {
+			break
+		}
+		rlog.Warn("模型 %s 请求失败: %v，回退到 %s", req.Model, err, model)
+		req.Model = model
+		err = send()
+	}
+	return req, err
+}
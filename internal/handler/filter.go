@@ -0,0 +1,78 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// 输入过滤命中后的处理方式
+const (
+	filterActionReject = "reject" // 拒绝请求
+	filterActionRedact = "redact" // 替换命中的内容后继续
+)
+
+var (
+	inputFilterPatterns     []*regexp.Regexp
+	inputFilterPatternsOnce sync.Once
+)
+
+// getInputFilterPatterns 编译配置中的输入过滤规则
+func getInputFilterPatterns() []*regexp.Regexp {
+	inputFilterPatternsOnce.Do(func() {
+		for _, p := range config.Get().InputFilter.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				log.Warn("[Filter] 忽略无效的输入过滤规则 %q: %v", p, err)
+				continue
+			}
+			inputFilterPatterns = append(inputFilterPatterns, re)
+		}
+	})
+	return inputFilterPatterns
+}
+
+// inputFilterError 输入被过滤规则拒绝
+type inputFilterError struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *inputFilterError) Error() string { return e.Message }
+
+// filterInput 对发往 Cursor 的完整提示词（系统提示、消息、工具调用/结果）执行输入过滤
+// 未开启时不做任何处理；reject 模式命中时返回错误，redact 模式原地替换命中内容
+func filterInput(req *client.CursorChatRequest) *inputFilterError {
+	filter := config.Get().InputFilter
+	if !filter.Enabled {
+		return nil
+	}
+
+	patterns := getInputFilterPatterns()
+	for i := range req.Messages {
+		for j := range req.Messages[i].Parts {
+			part := &req.Messages[i].Parts[j]
+			for _, re := range patterns {
+				if !re.MatchString(part.Text) {
+					continue
+				}
+				if filter.Action == filterActionRedact {
+					log.Info("[Filter] 输入命中过滤规则 %s，已替换", re.String())
+					part.Text = re.ReplaceAllString(part.Text, filter.Replacement)
+					continue
+				}
+				log.Warn("[Filter] 输入命中过滤规则 %s，已拒绝", re.String())
+				if filter.ErrorType == "permission_error" {
+					return &inputFilterError{Status: http.StatusForbidden, Type: "permission_error", Message: "input blocked by content filter"}
+				}
+				return &inputFilterError{Status: http.StatusBadRequest, Type: "invalid_request_error", Message: "input blocked by content filter"}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"cursor2api/internal/client"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// readyCacheTTL 就绪检查结果的缓存时间，避免探针频繁请求上游
+	readyCacheTTL = 5 * time.Second
+	// readyCheckTimeout 单次就绪检查的超时时间
+	readyCheckTimeout = 3 * time.Second
+)
+
+// readyState 缓存的就绪检查结果
+var readyState struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+	// checking 正在进行的检查，完成时关闭；为 nil 表示没有检查在进行
+	checking chan struct{}
+}
+
+// Health 存活探针：进程正常即返回 200
+func Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Ready 就绪探针：上游 Cursor 可达时返回 200，否则返回 503
+// 检查结果缓存 readyCacheTTL
+func Ready(c *gin.Context) {
+	if err := readyCheck(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// readyCheck 返回缓存的就绪检查结果
+// 缓存过期时只发起一次上游检查（不持有锁），并发的探针等待同一次检查的结果
+func readyCheck(ctx context.Context) error {
+	readyState.mu.Lock()
+	if time.Since(readyState.checkedAt) < readyCacheTTL {
+		err := readyState.err
+		readyState.mu.Unlock()
+		return err
+	}
+	done := readyState.checking
+	if done == nil {
+		done = make(chan struct{})
+		readyState.checking = done
+		go pingUpstream(done)
+	}
+	readyState.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	readyState.mu.Lock()
+	defer readyState.mu.Unlock()
+	return readyState.err
+}
+
+// pingUpstream 检查上游连通性并更新缓存，完成后关闭 done
+// 检查不绑定任何一个探针请求的 context，发起检查的探针断开不影响其他等待者
+func pingUpstream(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+	err := upstreamPing(ctx)
+	cancel()
+	if err != nil {
+		log.Warn("[Ready] 上游检查失败: %v", err)
+	}
+
+	readyState.mu.Lock()
+	readyState.err = err
+	readyState.checkedAt = time.Now()
+	readyState.checking = nil
+	readyState.mu.Unlock()
+	close(done)
+}
+
+// upstreamPing 检查上游连通性（测试中替换为桩实现）
+var upstreamPing = func(ctx context.Context) error {
+	return client.GetService().Ping(ctx)
+}
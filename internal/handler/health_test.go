@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyConcurrentProbesShareOnePing(t *testing.T) {
+	var pings atomic.Int32
+	prev := upstreamPing
+	upstreamPing = func(ctx context.Context) error {
+		pings.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}
+	t.Cleanup(func() {
+		upstreamPing = prev
+		readyState.checkedAt = time.Time{}
+	})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, w := newTestContext(http.MethodGet, "/ready", "")
+			Ready(c)
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := pings.Load(); n != 1 {
+		t.Errorf("upstream pinged %d times, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probes took %v, want them to share one 200ms ping", elapsed)
+	}
+}
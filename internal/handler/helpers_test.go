@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// stubUpstream 上游桩：非流式返回 body，流式依次交付 batches 后返回 err
+// wait 为 true 时交付完 batches 后阻塞到 ctx 结束（模拟迟迟不结束的上游）
+type stubUpstream struct {
+	body    string
+	batches [][]client.CursorEvent
+	err     error
+	wait    bool
+	models  []string
+}
+
+func (s *stubUpstream) SendRequestWithIP(ctx context.Context, req client.CursorChatRequest, clientIP string) (string, error) {
+	s.models = append(s.models, req.Model)
+	if s.wait {
+		<-ctx.Done()
+		return s.body, context.Cause(ctx)
+	}
+	return s.body, s.err
+}
+
+func (s *stubUpstream) SendStreamRequestWithIP(ctx context.Context, req client.CursorChatRequest, onEvents func(events []client.CursorEvent) error, clientIP string) error {
+	s.models = append(s.models, req.Model)
+	for _, events := range s.batches {
+		if err := onEvents(events); err != nil {
+			if err == client.ErrStopStream {
+				return nil
+			}
+			return err
+		}
+	}
+	if s.wait {
+		<-ctx.Done()
+		return context.Cause(ctx)
+	}
+	return s.err
+}
+
+// useUpstream 在测试期间用桩替换上游服务
+func useUpstream(t *testing.T, stub *stubUpstream) {
+	t.Helper()
+	prev := upstream
+	upstream = func() upstreamSender { return stub }
+	t.Cleanup(func() { upstream = prev })
+}
+
+// withConfig 在测试期间修改全局配置，结束时恢复
+func withConfig(t *testing.T, modify func(cfg *config.Config)) {
+	t.Helper()
+	cfg := config.Get()
+	saved := *cfg
+	modify(cfg)
+	t.Cleanup(func() { *cfg = saved })
+}
+
+// textEvents 将文本按 delta 拆分为 text-delta 事件
+func textEvents(deltas ...string) []client.CursorEvent {
+	events := make([]client.CursorEvent, 0, len(deltas))
+	for _, d := range deltas {
+		events = append(events, client.CursorEvent{Type: "text-delta", Delta: d})
+	}
+	return events
+}
+
+// sseBody 以桩上游返回的 SSE 响应体
+func sseBody(deltas ...string) string {
+	var b strings.Builder
+	for _, d := range deltas {
+		data, _ := json.Marshal(client.CursorEvent{Type: "text-delta", Delta: d})
+		b.WriteString("data: " + string(data) + "\n\n")
+	}
+	return b.String()
+}
+
+// newTestContext 创建测试用的 gin context
+func newTestContext(method, target, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	return c, w
+}
+
+// sseEvent 解析后的 SSE 事件
+type sseEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// parseSSE 解析 Anthropic 格式的 SSE 响应
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var name string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatalf("invalid SSE data %q: %v", line, err)
+			}
+			events = append(events, sseEvent{Name: name, Data: data})
+		}
+	}
+	return events
+}
+
+// eventsNamed 返回指定名称的事件
+func eventsNamed(events []sseEvent, name string) []sseEvent {
+	var matched []sseEvent
+	for _, e := range events {
+		if e.Name == name {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// stopReason 返回 message_delta 中的 stop_reason
+func stopReason(t *testing.T, events []sseEvent) string {
+	t.Helper()
+	deltas := eventsNamed(events, "message_delta")
+	if len(deltas) != 1 {
+		t.Fatalf("got %d message_delta events, want 1", len(deltas))
+	}
+	reason, _ := deltas[0].Data["delta"].(map[string]interface{})["stop_reason"].(string)
+	return reason
+}
+
+// decodeJSON 解析 JSON 响应体
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+// parseRequest 解析 JSON 格式的 Anthropic 请求
+func parseRequest(t *testing.T, body string) MessagesRequest {
+	t.Helper()
+	var req MessagesRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("invalid request JSON: %v", err)
+	}
+	return req
+}
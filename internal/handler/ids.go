@@ -0,0 +1,87 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ID 长度（十六进制字符数）
+const (
+	minIDLength     = 16
+	defaultIDLength = 32
+)
+
+// idLength 返回 ID 随机部分的长度，由 id_length 配置
+func idLength() int {
+	n := config.Get().IDLength
+	if n <= 0 {
+		return defaultIDLength
+	}
+	return max(n, minIDLength)
+}
+
+// generateID 生成随机标识符（十六进制），长度由 id_length 配置
+func generateID() string {
+	n := idLength()
+	b := make([]byte, (n+1)/2)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)[:n]
+}
+
+// deriveID 由幂等种子、ID 类型和序号派生确定性标识符（十六进制），长度与 generateID 一致
+func deriveID(seed, kind string, index int) string {
+	sum := sha256.Sum256([]byte(seed + ":" + kind + ":" + strconv.Itoa(index)))
+	id := hex.EncodeToString(sum[:])
+	// sha256 只有 64 个十六进制字符，更长的 id_length 在此截断
+	return id[:min(idLength(), len(id))]
+}
+
+// responseIDs 为单个响应生成消息、工具调用和 Completion ID
+// 请求携带 Idempotency-Key 时由键派生确定性 ID，重试同一逻辑请求得到相同的 ID；否则为随机 ID
+type responseIDs struct {
+	seed  string
+	tools int // 已生成的 tool_use ID 数，作为下一个工具调用的序号
+}
+
+// newResponseIDs 创建本次请求的 ID 生成器
+func newResponseIDs(c *gin.Context) *responseIDs {
+	return &responseIDs{seed: c.GetString(middleware.IdempotencyKey)}
+}
+
+// next 生成一个 ID：有幂等种子时按类型和序号派生，否则随机生成
+func (r *responseIDs) next(kind string, index int) string {
+	if r.seed == "" {
+		return generateID()
+	}
+	return deriveID(r.seed, kind, index)
+}
+
+// message 生成 Anthropic 消息 ID
+func (r *responseIDs) message() string {
+	return "msg_" + r.next("msg", 0)
+}
+
+// toolUse 生成 tool_use ID；没有幂等键时全局唯一，避免多轮对话中不同轮次的工具调用 ID 重复
+func (r *responseIDs) toolUse() string {
+	id := "toolu_" + r.next("toolu", r.tools)
+	r.tools++
+	return id
+}
+
+// completion 生成 OpenAI Chat Completion ID
+func (r *responseIDs) completion() string {
+	return "chatcmpl-" + r.next("chatcmpl", 0)
+}
+
+// markResponseComplete 标记响应已成功写完，Idempotency-Key 请求的响应随后被缓存
+func markResponseComplete(c *gin.Context) {
+	c.Set(middleware.IdempotencyDoneKey, true)
+}
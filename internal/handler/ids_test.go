@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/middleware"
+)
+
+func TestGenerateIDNoCollisions(t *testing.T) {
+	const samples = 200000
+	seen := make(map[string]bool, samples)
+	for i := 0; i < samples; i++ {
+		id := generateID()
+		if len(id) != defaultIDLength {
+			t.Fatalf("len(%q) = %d, want %d", id, len(id), defaultIDLength)
+		}
+		if seen[id] {
+			t.Fatalf("collision after %d IDs: %s", i, id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestGenerateIDLength(t *testing.T) {
+	tests := []struct{ configured, want int }{
+		{0, defaultIDLength},
+		{4, minIDLength},
+		{24, 24},
+		{41, 41},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(cfg *config.Config) { cfg.IDLength = tt.configured })
+		if got := len(generateID()); got != tt.want {
+			t.Errorf("id_length=%d: len = %d, want %d", tt.configured, got, tt.want)
+		}
+	}
+}
+
+func TestResponseIDPrefixes(t *testing.T) {
+	c, _ := newTestContext(http.MethodPost, "/v1/messages", "")
+	ids := newResponseIDs(c)
+	for prefix, id := range map[string]string{"msg_": ids.message(), "toolu_": ids.toolUse(), "chatcmpl-": ids.completion()} {
+		if !strings.HasPrefix(id, prefix) || len(id) != len(prefix)+defaultIDLength {
+			t.Errorf("id %q, want prefix %q and %d random characters", id, prefix, defaultIDLength)
+		}
+	}
+}
+
+func TestResponseIDsDerivedFromIdempotencyKey(t *testing.T) {
+	newIDs := func() *responseIDs {
+		c, _ := newTestContext(http.MethodPost, "/v1/messages", "")
+		c.Set(middleware.IdempotencyKey, "key-1")
+		return newResponseIDs(c)
+	}
+	a, b := newIDs(), newIDs()
+	if a.message() != b.message() || a.toolUse() != b.toolUse() {
+		t.Error("IDs derived from the same Idempotency-Key should match")
+	}
+	if first, second := a.toolUse(), a.toolUse(); first == second {
+		t.Errorf("tool_use IDs within one response should differ: %s", first)
+	}
+}
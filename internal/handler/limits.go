@@ -0,0 +1,131 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cursor2api/internal/config"
+)
+
+// requestTooLargeError 请求超过大小限制（对应 413 request_too_large）
+type requestTooLargeError struct {
+	message string
+}
+
+func (e *requestTooLargeError) Error() string { return e.message }
+
+// bodyTooLarge 判断请求解析失败是否因为请求体超过 max_body_bytes（见 middleware.BodyLimit）
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// bindErrorStatus 请求解析失败时的状态码和错误类型
+func bindErrorStatus(err error) (int, string) {
+	if bodyTooLarge(err) {
+		return http.StatusRequestEntityTooLarge, "request_too_large"
+	}
+	return http.StatusBadRequest, "invalid_request_error"
+}
+
+// validateMessageLimits 检查消息数和消息内容总字节数，在转换为 Cursor 请求前拒绝超大请求
+// 超过消息数返回普通错误（400），超过内容大小返回 *requestTooLargeError（413）
+func validateMessageLimits(contents []interface{}) error {
+	limits := config.Get().RequestLimits
+	if limits.MaxMessages > 0 && len(contents) > limits.MaxMessages {
+		return fmt.Errorf("messages: at most %d messages are allowed, got %d", limits.MaxMessages, len(contents))
+	}
+	if limits.MaxContentBytes <= 0 {
+		return nil
+	}
+	total := 0
+	for _, content := range contents {
+		total += contentLength(content)
+		if total > limits.MaxContentBytes {
+			return &requestTooLargeError{message: fmt.Sprintf("messages: total content exceeds the maximum size of %d bytes", limits.MaxContentBytes)}
+		}
+	}
+	return nil
+}
+
+// validationErrorStatus validateMessageLimits 错误对应的状态码和错误类型
+func validationErrorStatus(err error) (int, string) {
+	var tooLarge *requestTooLargeError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, "request_too_large"
+	}
+	return http.StatusBadRequest, "invalid_request_error"
+}
+
+// contentLength 统计消息内容中所有字符串的总字节数（文本、工具输入、工具结果、图片数据等）
+func contentLength(content interface{}) int {
+	switch v := content.(type) {
+	case string:
+		return len(v)
+	case []interface{}:
+		n := 0
+		for _, item := range v {
+			n += contentLength(item)
+		}
+		return n
+	case map[string]interface{}:
+		n := 0
+		for _, item := range v {
+			n += contentLength(item)
+		}
+		return n
+	default:
+		return 0
+	}
+}
+
+// messageContents 收集 Anthropic 消息的内容，供 validateMessageLimits 使用
+func messageContents(messages []Message) []interface{} {
+	contents := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		contents[i] = msg.Content
+	}
+	return contents
+}
+
+// validateUserContent 要求至少有一条内容非空的 user 消息
+// 没有消息、只有 system 或所有 user 消息都是空白时，转换后的请求没有可回答的内容，上游会报错或一直不返回
+func validateUserContent(messages []Message) error {
+	for _, msg := range messages {
+		if msg.Role == "user" && hasContent(msg.Content) {
+			return nil
+		}
+	}
+	return errors.New("messages: at least one user message with non-empty content is required")
+}
+
+// hasContent 判断消息内容是否非空：文本去除空白后非空，或含有文本以外的内容块（工具结果、图片等）
+func hasContent(content interface{}) bool {
+	switch v := content.(type) {
+	case nil:
+		return false
+	case string:
+		return strings.TrimSpace(v) != ""
+	case map[string]interface{}:
+		return hasContent([]interface{}{v})
+	case []interface{}:
+		for _, item := range v {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if block["type"] != "text" {
+				return true
+			}
+			if text, _ := block["text"].(string); strings.TrimSpace(text) != "" {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
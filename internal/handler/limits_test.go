@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMessagesRejectsEmptyUserContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+	}{
+		{name: "no messages", messages: `[]`},
+		{name: "whitespace string", messages: `[{"role": "user", "content": "  \n\t "}]`},
+		{name: "whitespace text blocks", messages: `[{"role": "user", "content": [{"type": "text", "text": " "}, {"type": "text", "text": "\n"}]}]`},
+		{name: "empty block list", messages: `[{"role": "user", "content": []}]`},
+		{name: "assistant only", messages: `[{"role": "assistant", "content": "hello"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"model": "claude-sonnet-4-5", "max_tokens": 64, "system": "be brief", "messages": ` + tt.messages + `}`
+			stub := &stubUpstream{}
+			w := postMessages(t, stub, body, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400; body = %s", w.Code, w.Body.String())
+			}
+			assertAnthropicError(t, decodeJSON(t, w), "invalid_request_error")
+			if len(stub.models) != 0 {
+				t.Error("request reached upstream")
+			}
+		})
+	}
+}
+
+func TestValidateUserContentAcceptsNonTextBlocks(t *testing.T) {
+	messages := []Message{{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": " "},
+		map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_1", "content": "ok"},
+	}}}
+	if err := validateUserContent(messages); err != nil {
+		t.Errorf("validateUserContent() error: %v", err)
+	}
+}
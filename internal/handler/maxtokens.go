@@ -0,0 +1,46 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"cursor2api/internal/config"
+)
+
+// modelMaxTokens 查找 Cursor 模型对应的 max_tokens 配置
+// model_max_tokens 的键按子串匹配模型名（忽略大小写），取最长匹配
+func modelMaxTokens(cursorModel string) (config.MaxTokensConfig, bool) {
+	model := strings.ToLower(cursorModel)
+	var limits config.MaxTokensConfig
+	matched, found := "", false
+	for family, l := range config.Get().ModelMaxTokens {
+		family = strings.ToLower(family)
+		if strings.Contains(model, family) && len(family) >= len(matched) {
+			limits, matched, found = l, family, true
+		}
+	}
+	return limits, found
+}
+
+// resolveMaxTokens 计算发往上游的 max_tokens
+// 未指定时使用模型默认值；超过模型上限时返回错误（不静默截断）
+func resolveMaxTokens(cursorModel string, requested int) (int, error) {
+	limits, ok := modelMaxTokens(cursorModel)
+	if !ok {
+		return requested, nil
+	}
+	if requested <= 0 {
+		return limits.Default, nil
+	}
+	if limits.Max > 0 && requested > limits.Max {
+		return 0, fmt.Errorf("max_tokens: %d > %d, which is the maximum allowed number of output tokens for %s", requested, limits.Max, cursorModel)
+	}
+	return requested, nil
+}
+
+// reachedMaxTokens 判断输出是否达到了 max_tokens 上限（上游在此处截断了输出）
+// 上游不返回结束原因，按本地统计的输出 token 数判断；maxTokens<=0 表示未设置上限
+func reachedMaxTokens(outputTokens, maxTokens int) bool {
+	return maxTokens > 0 && outputTokens >= maxTokens
+}
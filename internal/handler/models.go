@@ -2,13 +2,20 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"cursor2api/internal/config"
+	"cursor2api/internal/middleware"
+	"cursor2api/internal/modelmap"
+
 	"github.com/gin-gonic/gin"
 )
 
-// SupportedModels 支持的模型列表
+// SupportedModels 内置的模型别名列表
 var SupportedModels = []string{
 	"claude-4.5-opus",
 	"claude-4.5-sonnet",
@@ -21,35 +28,158 @@ var SupportedModels = []string{
 }
 
 // Model 模型信息
+// 同时包含 OpenAI（object/created/owned_by）和 Anthropic（type/display_name/created_at）格式的字段，
+// 两种 SDK 以及 LiteLLM 的模型发现都能直接解析
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID          string `json:"id"`
+	Object      string `json:"object"`
+	Created     int64  `json:"created"`
+	OwnedBy     string `json:"owned_by"`
+	Type        string `json:"type"`
+	DisplayName string `json:"display_name"`
+	CreatedAt   string `json:"created_at"`
 }
 
-// ModelsResponse 模型列表响应
+// ModelsResponse 模型列表响应（OpenAI 格式，附带 Anthropic 的分页字段；列表一次返回全部模型）
 type ModelsResponse struct {
-	Object string  `json:"object"`
-	Data   []Model `json:"data"`
+	Object  string  `json:"object"`
+	Data    []Model `json:"data"`
+	HasMore bool    `json:"has_more"`
+	FirstID *string `json:"first_id"`
+	LastID  *string `json:"last_id"`
+}
+
+// availableModelIDs 返回对外公布的模型 ID：内置别名 + 模型映射中配置的别名（去重）
+func availableModelIDs() []string {
+	ids := make([]string, 0, len(SupportedModels))
+	seen := make(map[string]bool)
+	for _, id := range append(append([]string(nil), SupportedModels...), modelmap.Get().Aliases()...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// knownCursorModels 返回已知的 Cursor 模型：配置的 models 列表加上模型映射的所有目标模型
+func knownCursorModels() []string {
+	var models []string
+	seen := make(map[string]bool)
+	for _, id := range append(strings.Split(config.Get().Models, ","), modelmap.Get().Targets()...) {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[strings.ToLower(id)] {
+			seen[strings.ToLower(id)] = true
+			models = append(models, id)
+		}
+	}
+	return models
+}
+
+// unknownModelError 严格模型模式下请求了未知模型
+type unknownModelError struct {
+	model string
+}
+
+func (e *unknownModelError) Error() string {
+	return fmt.Sprintf("model: %s is not a known model, valid models: %s", e.model, strings.Join(availableModelIDs(), ", "))
+}
+
+// modelNotAllowedError 当前 API Key 不允许使用映射后的模型
+type modelNotAllowedError struct {
+	model string
+}
+
+func (e *modelNotAllowedError) Error() string {
+	return fmt.Sprintf("model: this API key is not permitted to use model %s", e.model)
+}
+
+// modelErrorStatus 按模型解析错误选择状态码和错误类型：
+// 未知模型为 404 not_found_error，API Key 无权使用为 403 permission_error，其余为 400
+func modelErrorStatus(err error) (int, string) {
+	var unknown *unknownModelError
+	if errors.As(err, &unknown) {
+		return http.StatusNotFound, "not_found_error"
+	}
+	var notAllowed *modelNotAllowedError
+	if errors.As(err, &notAllowed) {
+		return http.StatusForbidden, "permission_error"
+	}
+	return http.StatusBadRequest, "invalid_request_error"
+}
+
+// checkModelAllowed 校验当前 API Key 是否允许使用映射后的 Cursor 模型
+// api_key_models 中没有列出的 Key（以及未启用鉴权时）不限制
+func checkModelAllowed(c *gin.Context, cursorModel string) error {
+	allowed, ok := config.Get().APIKeyModels[c.GetString(middleware.APIKeyKey)]
+	if !ok {
+		return nil
+	}
+	for _, model := range allowed {
+		if strings.EqualFold(model, cursorModel) {
+			return nil
+		}
+	}
+	return &modelNotAllowedError{model: cursorModel}
+}
+
+// lookupModel 将客户端模型名映射为 Cursor 模型
+// strict_models 开启时，模型既不在 /v1/models 列表中、也没有命中映射规则则返回 *unknownModelError
+func lookupModel(model string) (string, error) {
+	target, matched := modelmap.Get().Lookup(model)
+	if matched || !config.Get().StrictModels {
+		return target, nil
+	}
+	key := modelmap.Normalize(model)
+	for _, id := range availableModelIDs() {
+		if modelmap.Normalize(id) == key {
+			return target, nil
+		}
+	}
+	return "", &unknownModelError{model: model}
+}
+
+// newModel 构造模型信息
+func newModel(id string, created time.Time) Model {
+	return Model{
+		ID:          id,
+		Object:      "model",
+		Created:     created.Unix(),
+		OwnedBy:     "cursor",
+		Type:        "model",
+		DisplayName: id,
+		CreatedAt:   created.UTC().Format(time.RFC3339),
+	}
 }
 
 // ListModels 返回支持的模型列表
 func ListModels(c *gin.Context) {
-	models := make([]Model, len(SupportedModels))
-	now := time.Now().Unix()
-
-	for i, id := range SupportedModels {
-		models[i] = Model{
-			ID:      id,
-			Object:  "model",
-			Created: now,
-			OwnedBy: "cursor",
-		}
+	ids := availableModelIDs()
+	models := make([]Model, len(ids))
+	now := time.Now()
+
+	for i, id := range ids {
+		models[i] = newModel(id, now)
 	}
 
-	c.JSON(http.StatusOK, ModelsResponse{
+	resp := ModelsResponse{
 		Object: "list",
 		Data:   models,
-	})
+	}
+	if len(ids) > 0 {
+		resp.FirstID, resp.LastID = &ids[0], &ids[len(ids)-1]
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetModel 返回单个模型的信息（GET /v1/models/:model），不在模型列表中时返回 404
+func GetModel(c *gin.Context) {
+	id := c.Param("model")
+	for _, known := range availableModelIDs() {
+		if known == id {
+			c.JSON(http.StatusOK, newModel(id, time.Now()))
+			return
+		}
+	}
+	abortWithError(c, http.StatusNotFound, "not_found_error", fmt.Sprintf("model: %s not found", id))
 }
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/modelmap"
+)
+
+func TestResolveCursorModelQueryOverride(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) { cfg.Models = "gpt-4o, gemini-2.5-pro" })
+	mapped, _ := lookupModel("claude-sonnet-4-5")
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{name: "no override uses the model map", query: "", want: mapped},
+		{name: "configured model", query: "?cursor_model=gemini-2.5-pro", want: "gemini-2.5-pro"},
+		{name: "case-insensitive", query: "?cursor_model=GPT-4o", want: "gpt-4o"},
+		{name: "model map target", query: "?cursor_model=" + modelmap.Get().Targets()[0], want: modelmap.Get().Targets()[0]},
+		{name: "unknown model", query: "?cursor_model=not-a-model", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestContext(http.MethodPost, "/v1/messages"+tt.query, "")
+			got, err := resolveCursorModel(c, "claude-sonnet-4-5")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
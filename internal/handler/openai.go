@@ -3,14 +3,18 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
 
 	"cursor2api/internal/client"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/tokenizer"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,9 +25,41 @@ var log = logger.Get().WithPrefix("Handler")
 type ChatCompletionRequest struct {
 	Model       string          `json:"model"`
 	Messages    []OpenAIMessage `json:"messages"`
-	Stream      bool            `json:"stream"`
-	Temperature float64         `json:"temperature,omitempty"`
+	Stream      *bool           `json:"stream"` // 未设置时根据 Accept 头判断
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
 	MaxTokens   int             `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens 新版 OpenAI 客户端使用的字段，优先于 MaxTokens
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+	// StreamOptions 流式选项，include_usage 为 true 时在 [DONE] 前发送带 usage 的最后一块
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// CursorContext 发送给 Cursor 的上下文（扩展字段），未设置时使用 cursor_context 配置
+	CursorContext []client.CursorContext `json:"cursor_context,omitempty"`
+
+	// noSystemAffix 不追加 system_affix 配置的前缀/后缀（请求头 X-No-System-Affix）
+	noSystemAffix bool
+}
+
+// StreamOptions OpenAI 流式选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// includeUsage 流式响应是否需要在最后一块中返回 usage
+func (r ChatCompletionRequest) includeUsage() bool {
+	return r.StreamOptions != nil && r.StreamOptions.IncludeUsage
+}
+
+// effectiveMaxTokens 返回生效的最大输出 token 数
+// 同时设置 max_tokens 与 max_completion_tokens 且取值不一致时返回错误
+func (r ChatCompletionRequest) effectiveMaxTokens() (int, error) {
+	if r.MaxCompletionTokens > 0 {
+		if r.MaxTokens > 0 && r.MaxTokens != r.MaxCompletionTokens {
+			return 0, fmt.Errorf("max_tokens (%d) conflicts with max_completion_tokens (%d); set only one of them", r.MaxTokens, r.MaxCompletionTokens)
+		}
+		return r.MaxCompletionTokens, nil
+	}
+	return r.MaxTokens, nil
 }
 
 // OpenAIMessage OpenAI 消息格式
@@ -64,6 +100,8 @@ type ChatCompletionChunk struct {
 	Created int64         `json:"created"`
 	Model   string        `json:"model"`
 	Choices []ChunkChoice `json:"choices"`
+	// Usage 仅在 stream_options.include_usage 开启时的最后一块中出现（此时 choices 为空）
+	Usage *OpenAIUsage `json:"usage,omitempty"`
 }
 
 // ChunkChoice 流式选项
@@ -77,86 +115,127 @@ type ChunkChoice struct {
 func ChatCompletions(c *gin.Context) {
 	var req ChatCompletionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if bodyTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": gin.H{"message": err.Error(), "type": "request_too_large"}})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+	req.noSystemAffix = skipSystemAffix(c)
+	contents := make([]interface{}, len(req.Messages))
+	for i, msg := range req.Messages {
+		contents[i] = msg.Content
+	}
+	if err := validateMessageLimits(contents); err != nil {
+		status, errType := validationErrorStatus(err)
+		c.JSON(status, gin.H{"error": gin.H{"message": err.Error(), "type": errType}})
 		return
 	}
 
-	log.Info("[OpenAI] 请求: 模型=%s, 消息数=%d, 流式=%v", req.Model, len(req.Messages), req.Stream)
+	start := time.Now()
+	maxTokens, err := req.effectiveMaxTokens()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+	if err := validateUserContent(req.toMessagesRequest(maxTokens).Messages); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+
+	stream := wantsStream(c, req.Stream)
 
-	cursorReq := convertOpenAIToCursor(req)
+	cursorModel, err := resolveCursorModel(c, req.Model)
+	if err != nil {
+		status, errType := modelErrorStatus(err)
+		c.JSON(status, gin.H{"error": gin.H{"message": err.Error(), "type": errType}})
+		return
+	}
+	defer metrics.ObserveRequest("chat_completions", cursorModel, stream, start)
 
-	if req.Stream {
-		handleOpenAIStream(c, cursorReq, req.Model)
+	if maxTokens, err = resolveMaxTokens(cursorModel, maxTokens); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+	requestLogger(c).Info("[OpenAI] 请求: 模型=%s -> %s, 消息数=%d, 流式=%v, 最大Token=%d", req.Model, cursorModel, len(req.Messages), stream, maxTokens)
+	cursorReq := convertOpenAIToCursor(req, maxTokens, cursorModel)
+	if ferr := filterInput(&cursorReq); ferr != nil {
+		c.JSON(ferr.Status, gin.H{"error": gin.H{"message": ferr.Message, "type": ferr.Type}})
+		return
+	}
+	if capture := sampleCapture(c); capture != nil {
+		defer capture.write(&req, &cursorReq)
+	}
+
+	ctx, cancel := requestContext(c, "[OpenAI]")
+	defer cancel()
+
+	if stream {
+		handleOpenAIStream(ctx, c, cursorReq, req.Model, req.includeUsage())
 	} else {
-		handleOpenAINonStream(c, cursorReq, req.Model)
+		handleOpenAINonStream(ctx, c, cursorReq, req.Model)
 	}
 }
 
 // convertOpenAIToCursor 将 OpenAI 请求转换为 Cursor 格式
-func convertOpenAIToCursor(req ChatCompletionRequest) client.CursorChatRequest {
-	messages := make([]client.CursorMessage, len(req.Messages))
-	for i, msg := range req.Messages {
-		messages[i] = client.CursorMessage{
-			Parts: []client.CursorPart{{Type: "text", Text: msg.Content}},
-			ID:    generateID(),
-			Role:  msg.Role,
+// 先转换为 Anthropic 请求，再复用 convertToCursor，保证两种接口的转换逻辑一致
+func convertOpenAIToCursor(req ChatCompletionRequest, maxTokens int, cursorModel string) client.CursorChatRequest {
+	return convertToCursor(req.toMessagesRequest(maxTokens), cursorModel)
+}
+
+// toMessagesRequest 将 OpenAI 请求转换为 Anthropic 请求
+// system/developer 消息合并到 System 字段，其余消息按原顺序保留
+func (r ChatCompletionRequest) toMessagesRequest(maxTokens int) MessagesRequest {
+	var systemTexts []string
+	messages := make([]Message, 0, len(r.Messages))
+	for _, msg := range r.Messages {
+		if msg.Role == "system" || msg.Role == "developer" {
+			systemTexts = append(systemTexts, msg.Content)
+			continue
 		}
+		messages = append(messages, Message{Role: msg.Role, Content: msg.Content})
 	}
 
-	return client.CursorChatRequest{
-		Context: []client.CursorContext{{
-			Type:     "file",
-			Content:  "",
-			FilePath: "/docs/",
-		}},
-		Model:    mapModelName(req.Model),
-		ID:       generateID(),
-		Messages: messages,
-		Trigger:  "submit-message",
+	return MessagesRequest{
+		Model:         r.Model,
+		Messages:      messages,
+		MaxTokens:     maxTokens,
+		Stream:        r.Stream,
+		System:        strings.Join(systemTexts, "\n"),
+		Temperature:   r.Temperature,
+		TopP:          r.TopP,
+		CursorContext: r.CursorContext,
+		noSystemAffix: r.noSystemAffix,
 	}
 }
 
 // handleOpenAIStream 处理 OpenAI 流式请求
-func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, model string) {
+func handleOpenAIStream(ctx context.Context, c *gin.Context, cursorReq client.CursorChatRequest, model string, includeUsage bool) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
-	id := "chatcmpl-" + generateID()
+	id := newResponseIDs(c).completion()
 	created := time.Now().Unix()
-	flusher, _ := c.Writer.(http.Flusher)
-
-	var buffer strings.Builder
-
-	svc := client.GetService()
-	_ = svc.SendStreamRequest(cursorReq, func(chunk string) {
-		buffer.WriteString(chunk)
-		content := buffer.String()
-		lines := strings.Split(content, "\n")
-
-		if !strings.HasSuffix(content, "\n") && len(lines) > 0 {
-			buffer.Reset()
-			buffer.WriteString(lines[len(lines)-1])
-			lines = lines[:len(lines)-1]
-		} else {
-			buffer.Reset()
-		}
+	out := newSSEWriter(c.Writer, streamFlusher(c))
 
-		for _, line := range lines {
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "" || data == "[DONE]" {
-				continue
-			}
-
-			var event CursorSSEEvent
-			if err := json.Unmarshal([]byte(data), &event); err != nil {
-				continue
-			}
+	filters := newOutputFilter()
+	whitespace := newWhitespaceCollapser()
+	// fullContent 为上游返回的全部文本，sentContent 为已下发给客户端的文本（上游出错时只按后者计 token）
+	var fullContent, sentContent strings.Builder
 
+	rlog := requestLogger(c)
+	start := time.Now()
+	handleEvents := func(events []client.CursorEvent) {
+		for _, event := range events {
 			if event.Type == "text-delta" && event.Delta != "" {
+				fullContent.WriteString(event.Delta)
+				text := whitespace.Apply(filters.Apply(event.Delta))
+				if text == "" {
+					continue
+				}
+				sentContent.WriteString(text)
 				chunk := ChatCompletionChunk{
 					ID:      id,
 					Object:  "chat.completion.chunk",
@@ -164,15 +243,50 @@ func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, mode
 					Model:   model,
 					Choices: []ChunkChoice{{
 						Index: 0,
-						Delta: OpenAIMessage{Content: event.Delta},
+						Delta: OpenAIMessage{Content: text},
 					}},
 				}
 				chunkJSON, _ := json.Marshal(chunk)
-				_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", chunkJSON)
-				flusher.Flush()
+				_, _ = fmt.Fprintf(out, "data: %s\n\n", chunkJSON)
+				out.Flush()
 			}
 		}
-	})
+	}
+	// 上游在返回任何事件之前失败时按 model_fallbacks 回退，已有内容下发后不再回退
+	cursorReq, err := streamWithFallback(ctx, c, cursorReq, func(events []client.CursorEvent) error {
+		// 客户端已断开：立即停止读取上游，不再写入
+		if clientGone(c) {
+			return client.ErrStopStream
+		}
+		handleEvents(events)
+		return nil
+	}, "")
+	upstreamLatency := time.Since(start)
+	if clientGone(c) {
+		rlog.Info("[OpenAI] 流被客户端取消，已中止上游请求")
+		return
+	}
+
+	// 软截止时间到达或服务关闭：以已生成的内容正常结束
+	if err != nil && softDeadlineReached(ctx) {
+		rlog.Info("[OpenAI] 软截止时间到达，返回部分内容")
+		err = nil
+	}
+	if err != nil && shuttingDown(ctx) {
+		rlog.Warn("[OpenAI] 服务关闭，提前结束响应")
+		err = nil
+	}
+
+	promptTokens := countInputTokens(cursorReq)
+	if err != nil {
+		rlog.Error("[OpenAI] 上游请求失败: %v, 上游耗时=%v", err, upstreamLatency)
+		recordTokens(c, cursorReq.Model, promptTokens, tokenizer.CountForModel(sentContent.String(), cursorReq.Model))
+		writeOpenAIStreamError(out, err)
+		return
+	}
+	completionTokens := tokenizer.CountForModel(fullContent.String(), cursorReq.Model)
+	rlog.Info("[OpenAI] 请求完成: finish_reason=stop, 输出Token=%d, 上游耗时=%v", completionTokens, upstreamLatency)
+	recordTokens(c, cursorReq.Model, promptTokens, completionTokens)
 
 	// 发送结束标记
 	reason := "stop"
@@ -183,62 +297,93 @@ func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, mode
 		Model:   model,
 		Choices: []ChunkChoice{{
 			Index:        0,
-			Delta:        OpenAIMessage{},
+			Delta:        OpenAIMessage{Content: whitespace.Apply(filters.Flush()) + whitespace.Flush()},
 			FinishReason: &reason,
 		}},
 	}
 	endJSON, _ := json.Marshal(endChunk)
-	_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", endJSON)
-	_, _ = c.Writer.WriteString("data: [DONE]\n\n")
-	flusher.Flush()
+	_, _ = fmt.Fprintf(out, "data: %s\n\n", endJSON)
+
+	// 与 OpenAI 一致：usage 单独放在 [DONE] 前的最后一块，choices 为空
+	if includeUsage {
+		usageChunk := ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChunkChoice{},
+			Usage: &OpenAIUsage{
+				PromptTokens:     promptTokens,
+				CompletionTokens: completionTokens,
+				TotalTokens:      promptTokens + completionTokens,
+			},
+		}
+		usageJSON, _ := json.Marshal(usageChunk)
+		_, _ = fmt.Fprintf(out, "data: %s\n\n", usageJSON)
+	}
+	_, _ = io.WriteString(out, "data: [DONE]\n\n")
+	out.Flush()
+	markResponseComplete(c)
+}
+
+// writeOpenAIStreamError 在流中发送 OpenAI 格式的错误块
+// 与 Anthropic 的 error 事件一样是流的最后一块：不再发送 finish_reason、usage 和 [DONE]，避免客户端把失败当作正常结束
+func writeOpenAIStreamError(out *sseWriter, err error) {
+	errJSON, _ := json.Marshal(gin.H{"error": gin.H{"message": err.Error(), "type": streamErrorType(err)}})
+	_, _ = fmt.Fprintf(out, "data: %s\n\n", errJSON)
+	out.Flush()
 }
 
 // handleOpenAINonStream 处理 OpenAI 非流式请求
-func handleOpenAINonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string) {
-	svc := client.GetService()
-	result, err := svc.SendRequest(cursorReq)
+func handleOpenAINonStream(ctx context.Context, c *gin.Context, cursorReq client.CursorChatRequest, model string) {
+	rlog := requestLogger(c)
+	start := time.Now()
+	// 上游请求失败时按 model_fallbacks 依次尝试后备模型
+	result, cursorReq, err := sendWithFallback(ctx, c, cursorReq, "")
+	upstreamLatency := time.Since(start)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		rlog.Error("[OpenAI] 上游请求失败: %v, 上游耗时=%v", err, upstreamLatency)
+		status, errType := upstreamErrorStatus(ctx, err, http.StatusServiceUnavailable)
+		c.JSON(status, gin.H{"error": gin.H{"message": err.Error(), "type": errType}})
 		return
 	}
 
-	// 解析响应
+	// 解析响应（上游返回 error 事件或非 SSE 内容时返回 502）
+	events := client.ParseEvents(result)
+	if err := client.CheckResponse(result, events); err != nil {
+		rlog.Error("[OpenAI] 上游响应异常: %v, 上游耗时=%v", err, upstreamLatency)
+		c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{"message": err.Error(), "type": "api_error"}})
+		return
+	}
 	var fullContent strings.Builder
-	lines := strings.Split(result, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "" || data == "[DONE]" {
-			continue
-		}
-
-		var event CursorSSEEvent
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
-		}
-
+	for _, event := range events {
 		if event.Type == "text-delta" {
 			fullContent.WriteString(event.Delta)
 		}
 	}
 
+	content := applyOutputFilters(fullContent.String())
+	promptTokens := countInputTokens(cursorReq)
+	completionTokens := tokenizer.CountForModel(content, cursorReq.Model)
+	rlog.Info("[OpenAI] 请求完成: finish_reason=stop, 输出Token=%d, 上游耗时=%v", completionTokens, upstreamLatency)
+	recordTokens(c, cursorReq.Model, promptTokens, completionTokens)
+
 	reason := "stop"
+	markResponseComplete(c)
 	c.JSON(http.StatusOK, ChatCompletionResponse{
-		ID:      "chatcmpl-" + generateID(),
+		ID:      newResponseIDs(c).completion(),
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   model,
 		Choices: []Choice{{
 			Index:        0,
-			Message:      &OpenAIMessage{Role: "assistant", Content: fullContent.String()},
+			Message:      &OpenAIMessage{Role: "assistant", Content: content},
 			FinishReason: &reason,
 		}},
 		Usage: &OpenAIUsage{
-			PromptTokens:     100,
-			CompletionTokens: 100,
-			TotalTokens:      200,
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
 		},
 	})
 }
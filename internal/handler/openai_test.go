@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+func TestEffectiveMaxTokens(t *testing.T) {
+	tests := []struct {
+		name                string
+		maxTokens           int
+		maxCompletionTokens int
+		want                int
+		wantErr             bool
+	}{
+		{name: "max_tokens only", maxTokens: 512, want: 512},
+		{name: "max_completion_tokens only", maxCompletionTokens: 1024, want: 1024},
+		{name: "both equal", maxTokens: 2048, maxCompletionTokens: 2048, want: 2048},
+		{name: "both conflicting", maxTokens: 100, maxCompletionTokens: 200, wantErr: true},
+		{name: "neither", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := ChatCompletionRequest{MaxTokens: tt.maxTokens, MaxCompletionTokens: tt.maxCompletionTokens}
+			got, err := req.effectiveMaxTokens()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// openAIChunks 解析 OpenAI 格式的 SSE 响应，返回各数据块和是否以 [DONE] 结束
+func openAIChunks(t *testing.T, body string) (chunks []map[string]interface{}, done bool) {
+	t.Helper()
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, done
+}
+
+func TestHandleOpenAIStreamMidStreamError(t *testing.T) {
+	useUpstream(t, &stubUpstream{
+		batches: [][]client.CursorEvent{textEvents("Partial ", "answer")},
+		err:     &client.StatusError{StatusCode: http.StatusTooManyRequests},
+	})
+	c, w := newTestContext(http.MethodPost, "/v1/chat/completions", "")
+	handleOpenAIStream(context.Background(), c, client.CursorChatRequest{Model: "claude-4.5-sonnet"}, "claude-sonnet-4-5", true)
+
+	chunks, done := openAIChunks(t, w.Body.String())
+	if done {
+		t.Error("got [DONE] after an upstream error")
+	}
+	last := chunks[len(chunks)-1]
+	errBody, ok := last["error"].(map[string]interface{})
+	if !ok || errBody["type"] != "rate_limit_error" || errBody["message"] == "" {
+		t.Fatalf("last chunk = %v, want a rate_limit_error error chunk", last)
+	}
+	for _, chunk := range chunks {
+		if _, ok := chunk["usage"]; ok {
+			t.Error("got a usage chunk after an upstream error")
+		}
+		choices, _ := chunk["choices"].([]interface{})
+		for _, choice := range choices {
+			if reason := choice.(map[string]interface{})["finish_reason"]; reason != nil {
+				t.Errorf("finish_reason = %v, want none after an upstream error", reason)
+			}
+		}
+	}
+}
+
+func TestChatCompletionsErrorShape(t *testing.T) {
+	tests := []struct {
+		name       string
+		stub       *stubUpstream
+		body       string
+		wantStatus int
+		wantType   string
+	}{
+		{name: "invalid JSON", stub: &stubUpstream{}, body: `{"model": `, wantStatus: http.StatusBadRequest, wantType: "invalid_request_error"},
+		{name: "upstream failure", stub: &stubUpstream{err: errors.New("connection reset")}, body: `{"model": "claude-sonnet-4-5", "stream": false, "messages": [{"role": "user", "content": "hi"}]}`, wantStatus: http.StatusInternalServerError, wantType: "api_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, tt.stub)
+			c, w := newTestContext(http.MethodPost, "/v1/chat/completions", tt.body)
+			ChatCompletions(c)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body = %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			errBody, ok := decodeJSON(t, w)["error"].(map[string]interface{})
+			if !ok || errBody["type"] != tt.wantType || errBody["message"] == "" {
+				t.Errorf("body = %s, want an error object of type %s", w.Body.String(), tt.wantType)
+			}
+		})
+	}
+}
+
+func TestConvertOpenAIToCursorSamplingParams(t *testing.T) {
+	var req ChatCompletionRequest
+	body := `{"model": "claude-sonnet-4-5", "temperature": 0.2, "top_p": 0.9, "messages": [{"role": "user", "content": "hi"}]}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	withConfig(t, func(cfg *config.Config) { cfg.SamplingParams = []string{"temperature", "top_p"} })
+	cursorReq := convertOpenAIToCursor(req, 64, "claude-4.5-sonnet")
+	if cursorReq.Temperature == nil || *cursorReq.Temperature != 0.2 || cursorReq.TopP == nil || *cursorReq.TopP != 0.9 {
+		t.Errorf("temperature = %v, top_p = %v, want 0.2 and 0.9", cursorReq.Temperature, cursorReq.TopP)
+	}
+
+	withConfig(t, func(cfg *config.Config) { cfg.SamplingParams = nil })
+	if cursorReq := convertOpenAIToCursor(req, 64, "claude-4.5-sonnet"); cursorReq.Temperature != nil || cursorReq.TopP != nil {
+		t.Error("sampling params forwarded although sampling_params does not enable them")
+	}
+}
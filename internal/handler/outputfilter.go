@@ -0,0 +1,126 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"cursor2api/internal/config"
+)
+
+// defaultOutputFilterWindow 流式响应中为跨 delta 匹配缓存的默认字节数
+const defaultOutputFilterWindow = 256
+
+// outputRule 编译后的输出替换规则
+type outputRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+var (
+	outputRules     []outputRule
+	outputRulesOnce sync.Once
+)
+
+// getOutputRules 编译 output_filters 配置中的替换规则，无效的规则记录日志后忽略
+func getOutputRules() []outputRule {
+	outputRulesOnce.Do(func() {
+		for _, f := range config.Get().OutputFilters {
+			re, err := regexp.Compile(f.Pattern)
+			if err != nil {
+				log.Warn("[OutputFilter] 忽略无效的输出过滤规则 %q: %v", f.Pattern, err)
+				continue
+			}
+			outputRules = append(outputRules, outputRule{re: re, replace: f.Replace})
+		}
+	})
+	return outputRules
+}
+
+// applyOutputFilters 对完整文本依次执行 output_filters 的替换规则（非流式响应）
+func applyOutputFilters(text string) string {
+	for _, rule := range getOutputRules() {
+		text = rule.re.ReplaceAllString(text, rule.replace)
+	}
+	return text
+}
+
+// outputFilter 对流式增量依次执行 output_filters 的替换规则
+// 每条规则缓存末尾 window 字节，使跨 delta 的匹配也能被替换；单个匹配超过 window 字节时可能被拆开而漏掉
+// 未配置规则时原样返回，不缓存
+type outputFilter struct {
+	stages []*outputStage
+}
+
+// outputStage 单条规则及其缓存，前一条规则的输出作为后一条规则的输入
+type outputStage struct {
+	rule    outputRule
+	window  int
+	pending string
+}
+
+// newOutputFilter 按配置创建流式输出过滤器
+func newOutputFilter() *outputFilter {
+	window := config.Get().OutputFilterWindow
+	if window <= 0 {
+		window = defaultOutputFilterWindow
+	}
+	rules := getOutputRules()
+	f := &outputFilter{stages: make([]*outputStage, len(rules))}
+	for i, rule := range rules {
+		f.stages[i] = &outputStage{rule: rule, window: window}
+	}
+	return f
+}
+
+// Apply 处理一段增量，返回可以确定不再变化的输出
+func (f *outputFilter) Apply(delta string) string {
+	for _, s := range f.stages {
+		delta = s.apply(delta)
+	}
+	return delta
+}
+
+// Flush 文本块或流结束时处理并返回所有缓存的内容
+func (f *outputFilter) Flush() string {
+	var out string
+	for _, s := range f.stages {
+		out = s.flush(out)
+	}
+	return out
+}
+
+// apply 追加输入，替换并输出缓存末尾 window 字节之前的内容
+// 跨越切分点的匹配整体留在缓存中，等后续内容到达后再替换
+func (s *outputStage) apply(delta string) string {
+	s.pending += delta
+	cut := len(s.pending) - s.window
+	if cut <= 0 {
+		return ""
+	}
+	for _, loc := range s.rule.re.FindAllStringIndex(s.pending, -1) {
+		if loc[0] < cut && loc[1] > cut {
+			cut = loc[0]
+			break
+		}
+	}
+	// 不在 UTF-8 字符中间切分
+	for cut > 0 && !utf8.RuneStart(s.pending[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		return ""
+	}
+	out := s.rule.re.ReplaceAllString(s.pending[:cut], s.rule.replace)
+	s.pending = strings.Clone(s.pending[cut:])
+	return out
+}
+
+// flush 追加输入后替换并输出全部缓存
+func (s *outputStage) flush(delta string) string {
+	text := s.pending + delta
+	s.pending = ""
+	return s.rule.re.ReplaceAllString(text, s.rule.replace)
+}
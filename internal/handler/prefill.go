@@ -0,0 +1,92 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"strings"
+)
+
+// prefillInstruction 末尾为 assistant 消息（预填充）时追加的用户消息
+// Cursor 不会把最后一条 assistant 消息当作回复的开头，需要明确要求模型从预填充的末尾接着写
+const prefillInstruction = "Continue your previous response from exactly where it ends, as if it had not been interrupted. " +
+	"Output only the continuation: do not repeat any of the text you already wrote and do not add any preamble."
+
+// assistantPrefill 返回末尾 assistant 消息的预填充文本
+// 最后一条消息不是 assistant、没有文本，或含有文本以外的内容块（如 tool_use）时返回空字符串
+func assistantPrefill(messages []Message) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" {
+		return ""
+	}
+	switch v := last.Content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, item := range v {
+			text, ok := textBlockContent(item)
+			if !ok {
+				return ""
+			}
+			texts = append(texts, text)
+		}
+		return strings.Join(texts, "")
+	default:
+		return ""
+	}
+}
+
+// prefillTrimmer 去掉模型输出开头重复的预填充文本
+// 与 Anthropic 一致，响应只包含预填充之后的内容；模型仍把预填充原样重复一遍时，在流的开头缓存到能判断是否重复为止
+type prefillTrimmer struct {
+	prefill string
+	pending string
+	done    bool
+}
+
+// newPrefillTrimmer 创建去重器，prefill 为空时原样透传
+func newPrefillTrimmer(prefill string) *prefillTrimmer {
+	return &prefillTrimmer{prefill: prefill, done: prefill == ""}
+}
+
+// Feed 追加一段输出，返回可以下发的文本
+func (t *prefillTrimmer) Feed(text string) string {
+	if t.done {
+		return text
+	}
+	t.pending += text
+	if len(t.pending) < len(t.prefill) {
+		// 仍可能是预填充的开头，继续缓存
+		if strings.HasPrefix(t.prefill, t.pending) {
+			return ""
+		}
+		return t.release()
+	}
+	if strings.HasPrefix(t.pending, t.prefill) {
+		t.pending = t.pending[len(t.prefill):]
+	}
+	return t.release()
+}
+
+// Flush 流结束时返回缓存的内容（输出比预填充短且与其开头相同的情况）
+func (t *prefillTrimmer) Flush() string {
+	if t.done {
+		return ""
+	}
+	return t.release()
+}
+
+func (t *prefillTrimmer) release() string {
+	out := t.pending
+	t.pending = ""
+	t.done = true
+	return out
+}
+
+// trimPrefill 去掉完整输出开头重复的预填充文本（非流式）
+func trimPrefill(text, prefill string) string {
+	t := newPrefillTrimmer(prefill)
+	return t.Feed(text) + t.Flush()
+}
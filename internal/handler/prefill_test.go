@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+)
+
+const prefillRequest = `{"model": "claude-sonnet-4-5", "max_tokens": 64, "messages": [
+	{"role": "user", "content": "List three colors as JSON."},
+	{"role": "assistant", "content": "{\"colors\": ["}
+]}`
+
+func TestConvertToCursorPrefill(t *testing.T) {
+	req := parseRequest(t, prefillRequest)
+	if got := assistantPrefill(req.Messages); got != `{"colors": [` {
+		t.Fatalf("assistantPrefill() = %q", got)
+	}
+	msgs := convertToCursor(req, "claude-4.5-sonnet").Messages
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if msgs[1].Role != "assistant" || msgs[1].Parts[0].Text != `{"colors": [` {
+		t.Errorf("prefill message = %+v", msgs[1])
+	}
+	if last := msgs[2]; last.Role != "user" || last.Parts[0].Text != prefillInstruction {
+		t.Errorf("last message = %+v, want the continuation instruction", last)
+	}
+}
+
+func TestAssistantPrefillIgnoresToolUse(t *testing.T) {
+	messages := []Message{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "Checking."},
+			map[string]interface{}{"type": "tool_use", "id": "toolu_1", "name": "Ping", "input": map[string]interface{}{}},
+		}},
+	}
+	if got := assistantPrefill(messages); got != "" {
+		t.Errorf("assistantPrefill() = %q, want empty", got)
+	}
+}
+
+func TestTrimPrefill(t *testing.T) {
+	prefill := `{"colors": [`
+	tests := []struct{ output, want string }{
+		{output: `"red", "green", "blue"]}`, want: `"red", "green", "blue"]}`},
+		{output: `{"colors": ["red"]}`, want: `"red"]}`},
+		{output: `{"col`, want: `{"col`},
+		{output: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := trimPrefill(tt.output, prefill); got != tt.want {
+			t.Errorf("trimPrefill(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestPrefillTrimmerAcrossDeltas(t *testing.T) {
+	trimmer := newPrefillTrimmer("Once upon")
+	var out strings.Builder
+	for _, delta := range []string{"On", "ce up", "on a time"} {
+		out.WriteString(trimmer.Feed(delta))
+	}
+	out.WriteString(trimmer.Flush())
+	if out.String() != " a time" {
+		t.Errorf("output = %q, want %q", out.String(), " a time")
+	}
+}
+
+func TestHandleStreamPrefillNotDuplicated(t *testing.T) {
+	stub := &stubUpstream{batches: [][]client.CursorEvent{textEvents(`{"colors": `, `["red"]}`)}}
+	w := postMessages(t, stub, strings.Replace(prefillRequest, `"max_tokens": 64,`, `"max_tokens": 64, "stream": true,`, 1), nil)
+	if text := streamedText(parseSSE(t, w.Body.String())); text != `"red"]}` {
+		t.Errorf("streamed text = %q, want only the continuation", text)
+	}
+}
+
+func TestHandleNonStreamPrefillNotDuplicated(t *testing.T) {
+	status, body := runNonStream(t, &stubUpstream{body: sseBody(`{"colors": ["red"]}`)}, nil, nil, `{"colors": [`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, body)
+	}
+	block := body["content"].([]interface{})[0].(map[string]interface{})
+	if block["text"] != `"red"]}` {
+		t.Errorf("text = %q, want only the continuation", block["text"])
+	}
+}
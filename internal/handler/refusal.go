@@ -0,0 +1,151 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// 模型拒绝回答时的处理策略
+const (
+	refusalPassthrough = "passthrough" // 原样返回
+	refusalReprompt    = "reprompt"    // 在最后一条用户消息后追加引导语重新请求
+)
+
+var (
+	refusalPatterns     []*regexp.Regexp
+	refusalPatternsOnce sync.Once
+)
+
+// getRefusalPatterns 编译拒绝回答的检测正则（忽略大小写），并检查策略配置
+func getRefusalPatterns() []*regexp.Regexp {
+	refusalPatternsOnce.Do(func() {
+		cfg := config.Get().Refusal
+		if cfg.Strategy != "" && cfg.Strategy != refusalPassthrough && cfg.Strategy != refusalReprompt {
+			log.Warn("[Refusal] 不支持的拒绝处理策略 %q（可选 passthrough / reprompt），按 passthrough 处理", cfg.Strategy)
+		}
+		for _, p := range cfg.Patterns {
+			re, err := regexp.Compile("(?i)" + p)
+			if err != nil {
+				log.Warn("[Refusal] 忽略无效的拒绝检测规则 %q: %v", p, err)
+				continue
+			}
+			refusalPatterns = append(refusalPatterns, re)
+		}
+	})
+	return refusalPatterns
+}
+
+// maxReprompts 本次请求最多因拒绝回答重新请求的次数，策略不是 reprompt 时为 0
+func maxReprompts() int {
+	cfg := config.Get().Refusal
+	if cfg.Strategy != refusalReprompt || len(getRefusalPatterns()) == 0 {
+		return 0
+	}
+	return max(cfg.MaxReprompts, 0)
+}
+
+// detectRefusal 判断响应开头（detect_bytes 字节内）是否为拒绝回答
+func detectRefusal(text string) bool {
+	if limit := config.Get().Refusal.DetectBytes; limit > 0 && len(text) > limit {
+		text = text[:limit]
+	}
+	text = strings.TrimSpace(text)
+	for _, re := range getRefusalPatterns() {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// repromptRequest 在最后一条用户消息末尾追加引导语，生成重新请求的 Cursor 请求（不修改原请求）
+func repromptRequest(req client.CursorChatRequest) client.CursorChatRequest {
+	nudge := config.Get().Refusal.Nudge
+	messages := slices.Clone(req.Messages)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+		parts := slices.Clone(messages[i].Parts)
+		messages[i].Parts = append(parts, client.CursorPart{Type: "text", Text: nudge})
+		break
+	}
+	req.Messages = messages
+	req.ID = generateID()
+	return req
+}
+
+// cursorResponseText 提取非流式 Cursor 响应中的文本
+func cursorResponseText(body string) string {
+	var text strings.Builder
+	for _, event := range client.ParseEvents(body) {
+		if event.Type == "text-delta" {
+			text.WriteString(event.Delta)
+		}
+	}
+	return text.String()
+}
+
+// refusalGate 流式响应开头的拒绝检测
+// 开头的事件先缓存，文本达到 detect_bytes 仍未判定为拒绝时一次性放行，之后的事件直接通过
+type refusalGate struct {
+	limit int
+	held  []client.CursorEvent
+	text  strings.Builder
+	open  bool
+}
+
+// newRefusalGate 创建拒绝检测器
+func newRefusalGate() *refusalGate {
+	return &refusalGate{limit: config.Get().Refusal.DetectBytes}
+}
+
+// Feed 追加事件，返回可以下发的事件；refused 为 true 表示已判定为拒绝回答（事件仍保留在缓存中）
+func (g *refusalGate) Feed(events []client.CursorEvent) (pass []client.CursorEvent, refused bool) {
+	if g.open {
+		return events, false
+	}
+	g.hold(events)
+	if detectRefusal(g.text.String()) {
+		return nil, true
+	}
+	if g.text.Len() < g.limit {
+		return nil, false
+	}
+	return g.Release(), false
+}
+
+// Close 流结束时追加最后的事件并做出判定：不是拒绝时返回全部缓存的事件
+func (g *refusalGate) Close(events []client.CursorEvent) (pass []client.CursorEvent, refused bool) {
+	if g.open {
+		return events, false
+	}
+	g.hold(events)
+	if detectRefusal(g.text.String()) {
+		return nil, true
+	}
+	return g.Release(), false
+}
+
+// Release 放行并返回缓存的事件（不再重新请求时，拒绝回答也原样下发）
+func (g *refusalGate) Release() []client.CursorEvent {
+	g.open = true
+	held := g.held
+	g.held = nil
+	return held
+}
+
+func (g *refusalGate) hold(events []client.CursorEvent) {
+	g.held = append(g.held, events...)
+	for _, event := range events {
+		if event.Type == "text-delta" {
+			g.text.WriteString(event.Delta)
+		}
+	}
+}
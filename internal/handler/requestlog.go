@@ -0,0 +1,44 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"strings"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+	"cursor2api/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sensitiveHeaders 记录请求头时需要隐藏的头（小写）
+var sensitiveHeaders = map[string]bool{
+	"authorization": true,
+	"x-api-key":     true,
+	"cookie":        true,
+}
+
+// requestLogger 返回附带 request_id 字段的日志器
+func requestLogger(c *gin.Context) *logger.Logger {
+	return log.With("request_id", c.GetString(middleware.RequestIDKey))
+}
+
+// logContent 是否在日志中记录请求头和消息内容（log_content 配置，默认关闭）
+func logContent() bool {
+	return config.Get().LogContent
+}
+
+// logRequestHeaders 在 log_content 开启时记录请求头，鉴权相关的头只记录长度
+func logRequestHeaders(rlog *logger.Logger, c *gin.Context) {
+	if !logContent() {
+		return
+	}
+	rlog.Debug("请求头:")
+	for key, values := range c.Request.Header {
+		value := strings.Join(values, ", ")
+		if sensitiveHeaders[strings.ToLower(key)] {
+			value = strings.Repeat("*", min(len(value), 8))
+		}
+		rlog.Debug("  %s: %s", key, value)
+	}
+}
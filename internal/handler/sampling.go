@@ -0,0 +1,45 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// applySamplingParams 把请求中的采样参数写入 Cursor 请求
+// 未在 sampling_params 中启用的参数静默丢弃，仅记录 debug 日志
+func applySamplingParams(cursorReq *client.CursorChatRequest, req MessagesRequest) {
+	enabled := make(map[string]bool)
+	for _, name := range config.Get().SamplingParams {
+		enabled[name] = true
+	}
+
+	var dropped []string
+	if req.Temperature != nil {
+		if enabled["temperature"] {
+			cursorReq.Temperature = req.Temperature
+		} else {
+			dropped = append(dropped, "temperature")
+		}
+	}
+	if req.TopP != nil {
+		if enabled["top_p"] {
+			cursorReq.TopP = req.TopP
+		} else {
+			dropped = append(dropped, "top_p")
+		}
+	}
+	if req.TopK != nil {
+		if enabled["top_k"] {
+			cursorReq.TopK = req.TopK
+		} else {
+			dropped = append(dropped, "top_k")
+		}
+	}
+
+	if len(dropped) > 0 {
+		log.Debug("丢弃上游不支持的采样参数: %s", strings.Join(dropped, ", "))
+	}
+}
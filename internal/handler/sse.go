@@ -0,0 +1,124 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inputJSONFragmentSize 单个 input_json_delta 携带的最大字节数
+const inputJSONFragmentSize = 64
+
+// writeSSE 写出一个 SSE 事件，data 整体由 json.Marshal 序列化，转义全部交给标准库处理
+func writeSSE(w io.Writer, event string, data interface{}) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		log.Error("[SSE] 序列化事件 %s 失败: %v", event, err)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dataJSON)
+}
+
+// splitJSONFragments 把 JSON 文本按 size 字节拆分，不在多字节字符中间截断
+// 各片段按顺序拼接后与原文本逐字节一致
+func splitJSONFragments(s string, size int) []string {
+	var fragments []string
+	for len(s) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(s[end]) {
+			end--
+		}
+		if end == 0 {
+			end = size
+		}
+		fragments = append(fragments, s[:end])
+		s = s[end:]
+	}
+	return append(fragments, s)
+}
+
+// sseWriter 串行化 SSE 写入，允许保活 goroutine 与主流程并发写事件
+type sseWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	flusher   http.Flusher
+	lastWrite time.Time
+}
+
+// newSSEWriter 创建 SSE 写入器
+func newSSEWriter(w io.Writer, flusher http.Flusher) *sseWriter {
+	return &sseWriter{w: w, flusher: flusher, lastWrite: time.Now()}
+}
+
+// Write 实现 io.Writer（writeSSE 每个事件只调用一次 Write，事件不会被打断）
+func (s *sseWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWrite = time.Now()
+	return s.w.Write(p)
+}
+
+// Flush 把已写入的事件发送给客户端（不支持 Flush 时为空操作）
+func (s *sseWriter) Flush() {
+	if s.flusher == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flusher.Flush()
+}
+
+// streamFlusher 获取响应的 http.Flusher
+// 部分中间件包装的 ResponseWriter 不支持 Flush，此时返回 nil：事件照常写入，由响应结束时一次性发送
+func streamFlusher(c *gin.Context) http.Flusher {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		requestLogger(c).Warn("[SSE] ResponseWriter 不支持 Flush，流式事件将在响应结束时一次性发送")
+		return nil
+	}
+	return flusher
+}
+
+// startPing 启动保活：超过 interval 没有写入任何事件时发送 ping 事件
+// 返回的函数停止保活并等待 goroutine 退出；interval<=0 时不启动
+func (s *sseWriter) startPing(interval time.Duration) (stop func()) {
+	// 无法 Flush 时 ping 不会及时送达，不启动
+	if interval <= 0 || s.flusher == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				idle := time.Since(s.lastWrite)
+				s.mu.Unlock()
+				if idle >= interval {
+					writeSSE(s, "ping", map[string]string{"type": "ping"})
+					s.Flush()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSSEWriterWithoutFlusher(t *testing.T) {
+	var buf bytes.Buffer
+	out := newSSEWriter(&buf, nil)
+
+	// 不支持 Flush 时不启动保活，Flush 为空操作，事件照常写入
+	stop := out.startPing(time.Millisecond)
+	writeSSE(out, "message_start", map[string]string{"type": "message_start"})
+	out.Flush()
+	time.Sleep(5 * time.Millisecond)
+	writeSSE(out, "message_stop", map[string]string{"type": "message_stop"})
+	out.Flush()
+	stop()
+
+	events := parseSSE(t, buf.String())
+	if len(events) != 2 || events[0].Name != "message_start" || events[1].Name != "message_stop" {
+		t.Errorf("events = %+v, want message_start and message_stop only", events)
+	}
+}
+
+func TestSplitJSONFragmentsKeepsRunes(t *testing.T) {
+	input := `{"content":"` + strings.Repeat("你好🚀", 30) + `"}`
+	fragments := splitJSONFragments(input, 7)
+	if strings.Join(fragments, "") != input {
+		t.Fatal("fragments do not reassemble to the input")
+	}
+	for _, f := range fragments {
+		if !utf8.ValidString(f) {
+			t.Errorf("fragment %q splits a multi-byte character", f)
+		}
+	}
+}
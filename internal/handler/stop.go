@@ -0,0 +1,120 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"cursor2api/internal/config"
+)
+
+// validateStopSequences 校验停止序列：数量、非空、长度
+func validateStopSequences(sequences []string) error {
+	cfg := config.Get()
+	if cfg.MaxStopSequences > 0 && len(sequences) > cfg.MaxStopSequences {
+		return fmt.Errorf("stop_sequences: at most %d stop sequences are allowed, got %d", cfg.MaxStopSequences, len(sequences))
+	}
+	for i, seq := range sequences {
+		if seq == "" {
+			return fmt.Errorf("stop_sequences.%d: stop sequences must not be empty", i)
+		}
+		if cfg.MaxStopSequenceLength > 0 && len(seq) > cfg.MaxStopSequenceLength {
+			return fmt.Errorf("stop_sequences.%d: stop sequence exceeds the maximum length of %d bytes", i, cfg.MaxStopSequenceLength)
+		}
+	}
+	return nil
+}
+
+// truncateAtStopSequence 在完整文本中查找最早出现的停止序列
+// 命中时返回截断到匹配位置之前的文本和命中的停止序列，未命中原样返回
+func truncateAtStopSequence(text string, sequences []string) (string, string) {
+	m := newStopMatcher(sequences)
+	if out, stopped := m.Feed(text); stopped {
+		return out, m.Matched()
+	}
+	return text, ""
+}
+
+// stopMatcher 在流式增量中检测停止序列
+// 为捕获跨 delta 拆分的停止序列，始终保留末尾 (最长停止序列长度-1+宽限字节) 不立即下发
+type stopMatcher struct {
+	sequences []string
+	holdBack  int
+	pending   string
+	matched   string // 命中的停止序列
+}
+
+// newStopMatcher 创建停止序列检测器
+func newStopMatcher(sequences []string) *stopMatcher {
+	m := &stopMatcher{}
+	longest := 0
+	for _, seq := range sequences {
+		if seq == "" {
+			continue
+		}
+		m.sequences = append(m.sequences, seq)
+		if len(seq) > longest {
+			longest = len(seq)
+		}
+	}
+	if longest > 0 {
+		m.holdBack = longest - 1 + config.Get().StopSequenceGrace
+	}
+	return m
+}
+
+// Feed 追加一段增量，返回可以安全下发的文本
+// 命中停止序列时返回截断到匹配位置之前的文本，并返回 stopped=true
+func (m *stopMatcher) Feed(delta string) (out string, stopped bool) {
+	if m.matched != "" {
+		return "", true
+	}
+	m.pending += delta
+
+	if idx, seq := m.find(); idx >= 0 {
+		out = m.pending[:idx]
+		m.pending = ""
+		m.matched = seq
+		return out, true
+	}
+
+	safe := len(m.pending) - m.holdBack
+	if safe <= 0 {
+		return "", false
+	}
+	// 不在多字节字符中间截断
+	for safe > 0 && safe < len(m.pending) && !utf8.RuneStart(m.pending[safe]) {
+		safe--
+	}
+	out = m.pending[:safe]
+	m.pending = m.pending[safe:]
+	return out, false
+}
+
+// Flush 流结束且未命中停止序列时，返回剩余的保留文本
+func (m *stopMatcher) Flush() string {
+	out := m.pending
+	m.pending = ""
+	return out
+}
+
+// Matched 返回命中的停止序列，未命中返回空字符串
+func (m *stopMatcher) Matched() string {
+	return m.matched
+}
+
+// find 查找最早出现的停止序列，位置相同时取较长者
+func (m *stopMatcher) find() (int, string) {
+	best, bestSeq := -1, ""
+	for _, seq := range m.sequences {
+		idx := strings.Index(m.pending, seq)
+		if idx < 0 {
+			continue
+		}
+		if best < 0 || idx < best || (idx == best && len(seq) > len(bestSeq)) {
+			best, bestSeq = idx, seq
+		}
+	}
+	return best, bestSeq
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// feedChars 逐字符喂入 stopMatcher，返回下发的文本和是否命中
+func feedChars(m *stopMatcher, text string) (string, bool) {
+	var out strings.Builder
+	for _, r := range text {
+		chunk, stopped := m.Feed(string(r))
+		out.WriteString(chunk)
+		if stopped {
+			return out.String(), true
+		}
+	}
+	out.WriteString(m.Flush())
+	return out.String(), false
+}
+
+func TestStopMatcherOneCharPerDelta(t *testing.T) {
+	const stop = "<<STOP10>>" // 10 个字符
+	m := newStopMatcher([]string{stop})
+	out, stopped := feedChars(m, "hello world<<STOP10>>never sent")
+	if !stopped || m.Matched() != stop {
+		t.Fatalf("stopped = %v, matched = %q, want %q", stopped, m.Matched(), stop)
+	}
+	if out != "hello world" {
+		t.Errorf("out = %q, want truncation exactly at the match", out)
+	}
+}
+
+func TestStopMatcherFlushesHeldBytes(t *testing.T) {
+	m := newStopMatcher([]string{"<<STOP10>>"})
+	// 末尾是停止序列的前缀但没有命中：结束时必须原样下发
+	out, stopped := feedChars(m, "almost <<STOP1")
+	if stopped {
+		t.Fatal("unexpected stop")
+	}
+	if out != "almost <<STOP1" {
+		t.Errorf("out = %q, want all text flushed", out)
+	}
+}
+
+func TestStopMatcherGrace(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) { cfg.StopSequenceGrace = 4 })
+	m := newStopMatcher([]string{"END"})
+	if out, _ := m.Feed("abcdefg"); out != "a" {
+		t.Errorf("out = %q, want %q (holds back len-1+grace bytes)", out, "a")
+	}
+}
+
+func TestStopMatcherMultibyte(t *testing.T) {
+	m := newStopMatcher([]string{"停止"})
+	out, stopped := feedChars(m, "你好，世界停止之后")
+	if !stopped || out != "你好，世界" {
+		t.Errorf("out = %q, stopped = %v", out, stopped)
+	}
+}
+
+func TestHandleStreamStopSequenceSplitPerChar(t *testing.T) {
+	const stop = "<<STOP10>>"
+	var deltas []string
+	for _, r := range "Answer: 42" + stop + " trailing" {
+		deltas = append(deltas, string(r))
+	}
+	events := runStream(t, &stubUpstream{batches: [][]client.CursorEvent{textEvents(deltas...)}}, nil, []string{stop})
+
+	if text := streamedText(events); text != "Answer: 42" {
+		t.Errorf("text = %q, want %q", text, "Answer: 42")
+	}
+	if got := stopReason(t, events); got != "stop_sequence" {
+		t.Errorf("stop_reason = %q, want stop_sequence", got)
+	}
+	delta := eventsNamed(events, "message_delta")[0].Data["delta"].(map[string]interface{})
+	if delta["stop_sequence"] != stop {
+		t.Errorf("stop_sequence = %v, want %q", delta["stop_sequence"], stop)
+	}
+}
+
+func TestValidateStopSequences(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) {
+		cfg.MaxStopSequences = 3
+		cfg.MaxStopSequenceLength = 8
+	})
+	tests := []struct {
+		name      string
+		sequences []string
+		wantErr   string
+	}{
+		{name: "valid", sequences: []string{"END", "\n\nHuman:"}},
+		{name: "too many", sequences: []string{"a", "b", "c", "d"}, wantErr: "at most 3 stop sequences are allowed, got 4"},
+		{name: "empty", sequences: []string{"END", ""}, wantErr: "stop_sequences.1: stop sequences must not be empty"},
+		{name: "too long", sequences: []string{"123456789"}, wantErr: "stop_sequences.0: stop sequence exceeds the maximum length of 8 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStopSequences(tt.sequences)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMessagesRejectsInvalidStopSequences(t *testing.T) {
+	sequences, _ := json.Marshal(make([]string, config.Get().MaxStopSequences+1))
+	body := `{"model": "claude-sonnet-4-5", "max_tokens": 64, "stop_sequences": ` + string(sequences) + `, "messages": [{"role": "user", "content": "hi"}]}`
+	w := postMessages(t, &stubUpstream{}, body, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	assertAnthropicError(t, decodeJSON(t, w), "invalid_request_error")
+}
@@ -0,0 +1,148 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"cursor2api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 系统提示词的发送方式
+const (
+	systemModeSeparate = "separate" // 作为独立的 system 消息发送
+	systemModePrepend  = "prepend"  // 并入第一条用户消息
+)
+
+// systemSegment system 字段中的一个分段
+type systemSegment struct {
+	Label string
+	Text  string
+}
+
+// parseSystemSegments 将 system 字段解析为分段列表
+// 支持 string、单个内容块和 []ContentBlock 格式，数组中的块可携带 label 字段
+func parseSystemSegments(system interface{}) []systemSegment {
+	switch v := system.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []systemSegment{{Text: v}}
+	case map[string]interface{}:
+		// 单个内容块对象
+		return parseSystemSegments([]interface{}{v})
+	case []interface{}:
+		var segments []systemSegment
+		for _, item := range v {
+			text, ok := textBlockContent(item)
+			if !ok || text == "" {
+				continue
+			}
+			var label string
+			if block, ok := item.(map[string]interface{}); ok {
+				label, _ = block["label"].(string)
+			}
+			segments = append(segments, systemSegment{Label: label, Text: text})
+		}
+		return segments
+	default:
+		return []systemSegment{{Text: getTextContent(v)}}
+	}
+}
+
+// buildSystemText 组装系统提示词
+// 没有任何分段携带 label 时与原先一致（按顺序以换行拼接）；
+// 否则按 system_segment_order 配置排序，未列出的分段保持原顺序排在最后，并以 system_segment_separator 分隔
+func buildSystemText(system interface{}) string {
+	segments := parseSystemSegments(system)
+
+	labeled := false
+	for _, seg := range segments {
+		if seg.Label != "" {
+			labeled = true
+			break
+		}
+	}
+
+	texts := make([]string, 0, len(segments))
+	if !labeled {
+		for _, seg := range segments {
+			texts = append(texts, seg.Text)
+		}
+		return strings.Join(texts, "\n")
+	}
+
+	cfg := config.Get()
+	rank := make(map[string]int, len(cfg.SystemSegmentOrder))
+	for i, label := range cfg.SystemSegmentOrder {
+		rank[label] = i
+	}
+	rankOf := func(seg systemSegment) int {
+		if r, ok := rank[seg.Label]; ok {
+			return r
+		}
+		return len(cfg.SystemSegmentOrder)
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return rankOf(segments[i]) < rankOf(segments[j])
+	})
+
+	for _, seg := range segments {
+		texts = append(texts, seg.Text)
+	}
+	return strings.Join(texts, cfg.SystemSegmentSeparator)
+}
+
+// applySystemAffix 在系统提示词前后加上 system_affix 配置的前缀/后缀，各部分之间空一行
+// 客户端没有系统提示词时只由前缀和后缀组成；disabled 为 true 时原样返回
+func applySystemAffix(sysText string, disabled bool) string {
+	if disabled {
+		return sysText
+	}
+	affix := config.Get().SystemAffix
+	var parts []string
+	for _, part := range []string{affix.Prefix, sysText, affix.Suffix} {
+		if strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// skipSystemAffix 请求头 X-No-System-Affix 为真值时本次请求不追加系统提示词前缀/后缀
+func skipSystemAffix(c *gin.Context) bool {
+	v, err := strconv.ParseBool(c.GetHeader("X-No-System-Affix"))
+	return err == nil && v
+}
+
+// applyRefusalFraming 开启 refusal_framing 时将引导语加在系统提示词之前
+func applyRefusalFraming(sysText string) string {
+	framing := config.Get().RefusalFraming
+	if !framing.Enabled || strings.TrimSpace(framing.Text) == "" {
+		return sysText
+	}
+	if sysText == "" {
+		return framing.Text
+	}
+	return framing.Text + "\n\n" + sysText
+}
+
+// systemPromptMode 根据映射后的 Cursor 模型选择系统提示词的发送方式
+// system_prompt_modes 的键按子串匹配模型名（忽略大小写），取最长匹配；未匹配时为 separate
+func systemPromptMode(cursorModel string) string {
+	model := strings.ToLower(cursorModel)
+	mode, matched := systemModeSeparate, ""
+	for family, m := range config.Get().SystemPromptModes {
+		family = strings.ToLower(family)
+		if strings.Contains(model, family) && len(family) > len(matched) {
+			mode, matched = m, family
+		}
+	}
+	return mode
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"testing"
+
+	"cursor2api/internal/config"
+)
+
+func TestBuildSystemTextSegmentOrder(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) {
+		cfg.SystemSegmentOrder = []string{"persona", "constraints", "tools"}
+		cfg.SystemSegmentSeparator = "\n---\n"
+	})
+	req := parseRequest(t, `{"system": [
+		{"type": "text", "text": "Use tools wisely.", "label": "tools"},
+		{"type": "text", "text": "Extra notes."},
+		{"type": "text", "text": "Be concise.", "label": "constraints"},
+		{"type": "text", "text": "You are a helpful bot.", "label": "persona", "cache_control": {"type": "ephemeral"}}
+	], "messages": [{"role": "user", "content": "hi"}]}`)
+
+	want := "You are a helpful bot.\n---\nBe concise.\n---\nUse tools wisely.\n---\nExtra notes."
+	if got := buildSystemText(req.System); got != want {
+		t.Errorf("buildSystemText() = %q, want %q", got, want)
+	}
+	cursorReq := convertToCursor(req, "claude-4.5-sonnet")
+	if first := cursorReq.Messages[0]; first.Role != "system" || first.Parts[0].Text != want {
+		t.Errorf("system message = %+v, want %q", first, want)
+	}
+}
+
+func TestBuildSystemTextUnlabeledKeepsOrder(t *testing.T) {
+	req := parseRequest(t, `{"system": [
+		{"type": "text", "text": "first"},
+		{"type": "text", "text": "second"}
+	]}`)
+	if got := buildSystemText(req.System); got != "first\nsecond" {
+		t.Errorf("buildSystemText() = %q, want %q", got, "first\nsecond")
+	}
+}
+
+func TestConvertSystemPromptModes(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) {
+		cfg.SystemPromptModes = map[string]string{"gpt": systemModePrepend, "claude": systemModeSeparate}
+	})
+	req := parseRequest(t, `{"system": "Be brief.", "messages": [{"role": "user", "content": "hello"}]}`)
+
+	t.Run("claude keeps a separate system message", func(t *testing.T) {
+		msgs := convertToCursor(req, "claude-4.5-sonnet").Messages
+		if len(msgs) != 2 || msgs[0].Role != "system" || msgs[0].Parts[0].Text != "Be brief." {
+			t.Fatalf("messages = %+v, want system message first", msgs)
+		}
+		if msgs[1].Role != "user" || len(msgs[1].Parts) != 1 || msgs[1].Parts[0].Text != "hello" {
+			t.Errorf("user message = %+v", msgs[1])
+		}
+	})
+
+	t.Run("gpt prepends to the first user message", func(t *testing.T) {
+		msgs := convertToCursor(req, "gpt-5.2").Messages
+		if len(msgs) != 1 || msgs[0].Role != "user" {
+			t.Fatalf("messages = %+v, want a single user message", msgs)
+		}
+		parts := msgs[0].Parts
+		if len(parts) != 2 || parts[0].Text != "Be brief." || parts[1].Text != "hello" {
+			t.Errorf("parts = %+v, want system text before the user text", parts)
+		}
+	})
+}
+
+func TestSystemStringAndArrayShapes(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "string", body: `{"system": "You are helpful."}`, want: "You are helpful."},
+		{name: "array", body: `{"system": [
+			{"type": "text", "text": "You are helpful."},
+			{"type": "text", "text": "Answer in English.", "cache_control": {"type": "ephemeral"}}
+		]}`, want: "You are helpful.\nAnswer in English."},
+		{name: "single block object", body: `{"system": {"type": "text", "text": "Only block."}}`, want: "Only block."},
+		{name: "block without type", body: `{"system": [{"text": "Untyped block."}]}`, want: "Untyped block."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := parseRequest(t, tt.body)
+			if got := getTextContent(req.System); got != tt.want {
+				t.Errorf("getTextContent() = %q, want %q", got, tt.want)
+			}
+			if got := buildSystemText(req.System); got != tt.want {
+				t.Errorf("buildSystemText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import "fmt"
+
+// cursorReasoningDelta 上游推理内容增量事件
+const cursorReasoningDelta = "reasoning-delta"
+
+// ThinkingConfig 扩展思考配置（Anthropic thinking 参数）
+type ThinkingConfig struct {
+	Type         string `json:"type"` // enabled / disabled
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// thinkingEnabled 请求是否开启了扩展思考
+// 只有开启时才把上游的推理内容作为 thinking 块返回，不认识 thinking 块的客户端不受影响
+func thinkingEnabled(req MessagesRequest) bool {
+	return req.Thinking != nil && req.Thinking.Type == "enabled"
+}
+
+// thinkingBlockText 将历史中的 thinking 块渲染为文本，保持多轮对话中推理过程的连续性
+// redacted_thinking 只有加密数据，无法转发，返回空字符串
+func thinkingBlockText(block map[string]interface{}) string {
+	if block["type"] != "thinking" {
+		return ""
+	}
+	thinking, _ := block["thinking"].(string)
+	if thinking == "" {
+		return ""
+	}
+	return fmt.Sprintf("[Thinking]\n%s", thinking)
+}
@@ -0,0 +1,207 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+	"cursor2api/internal/toolify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 空工具输入的处理方式
+const (
+	emptyToolInputEmit  = "emit"  // 规范化为 {} 并照常返回工具调用
+	emptyToolInputError = "error" // 缺少 schema 必填字段时返回错误
+)
+
+// resolveToolInput 解析工具调用参数，缺失或为空时规范化为空对象
+// 若工具 schema 声明了必填字段而参数中缺失，按 empty_tool_input 配置决定报错或照常返回
+func resolveToolInput(tools []toolify.ToolDefinition, name, arguments string) (map[string]interface{}, error) {
+	var input map[string]interface{}
+	if strings.TrimSpace(arguments) != "" {
+		_ = json.Unmarshal([]byte(arguments), &input)
+	}
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+
+	missing := missingRequiredFields(tools, name, input)
+	if len(missing) == 0 {
+		return input, nil
+	}
+
+	if config.Get().EmptyToolInput == emptyToolInputError {
+		return nil, fmt.Errorf("tool call %s is missing required input fields: %s", name, strings.Join(missing, ", "))
+	}
+	log.Warn("[Anthropic] 工具 %s 缺少必填参数: %s", name, strings.Join(missing, ", "))
+	return input, nil
+}
+
+// missingRequiredFields 返回工具 schema 中声明为必填但输入中缺失的字段
+func missingRequiredFields(tools []toolify.ToolDefinition, name string, input map[string]interface{}) []string {
+	for _, tool := range tools {
+		if tool.GetName() != name {
+			continue
+		}
+		params := tool.GetParameters()
+		if params == nil {
+			return nil
+		}
+		required, _ := params["required"].([]interface{})
+		var missing []string
+		for _, field := range required {
+			key, ok := field.(string)
+			if !ok {
+				continue
+			}
+			if _, exists := input[key]; !exists {
+				missing = append(missing, key)
+			}
+		}
+		return missing
+	}
+	return nil
+}
+
+// toolUse 对话历史中助手发起的工具调用
+type toolUse struct {
+	Name  string
+	Input interface{}
+}
+
+// collectToolUses 收集对话历史中所有 tool_use 块，建立 tool_use_id -> 工具调用的映射
+// 客户端回传的 ID 原样保留，tool_result 据此关联到对应的工具调用
+func collectToolUses(messages []Message) map[string]toolUse {
+	uses := make(map[string]toolUse)
+	for _, msg := range messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		content, ok := msg.Content.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range content {
+			block, ok := item.(map[string]interface{})
+			if !ok || block["type"] != "tool_use" {
+				continue
+			}
+			id, _ := block["id"].(string)
+			name, _ := block["name"].(string)
+			if id != "" {
+				uses[id] = toolUse{Name: name, Input: block["input"]}
+			}
+		}
+	}
+	return uses
+}
+
+// toolResultLabel 生成 tool_result 的标题，能关联到历史中的 tool_use 时附带工具名
+func toolResultLabel(toolID string, toolUses map[string]toolUse) string {
+	if use, ok := toolUses[toolID]; ok && use.Name != "" {
+		return fmt.Sprintf("[Tool %s result] (tool_use_id: %s)", use.Name, toolID)
+	}
+	return fmt.Sprintf("[Tool %s result]", toolID)
+}
+
+// toolUseText 将历史中的 tool_use 块渲染为文本，让模型记得之前调用过哪些工具
+// 格式与 toolResultLabel 对应，通过 tool_use_id 关联到后续的 tool_result
+func toolUseText(block map[string]interface{}) string {
+	id, _ := block["id"].(string)
+	name, _ := block["name"].(string)
+	input := block["input"]
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+	inputJSON, _ := json.Marshal(input)
+	if id == "" {
+		return fmt.Sprintf("[Called tool %s with input: %s]", name, inputJSON)
+	}
+	return fmt.Sprintf("[Called tool %s (tool_use_id: %s) with input: %s]", name, id, inputJSON)
+}
+
+// validateToolChoice 校验 tool_choice 的类型及 type=tool 时指定的工具是否存在
+func validateToolChoice(choice *toolify.ToolChoice, tools []toolify.ToolDefinition) error {
+	if choice == nil {
+		return nil
+	}
+	switch choice.Type {
+	case toolify.ToolChoiceAuto, toolify.ToolChoiceAny, toolify.ToolChoiceNone:
+		return nil
+	case toolify.ToolChoiceTool:
+		if choice.Name == "" {
+			return fmt.Errorf("tool_choice.name: field required when tool_choice.type is \"tool\"")
+		}
+		for _, tool := range tools {
+			if tool.GetName() == choice.Name {
+				return nil
+			}
+		}
+		return fmt.Errorf("tool_choice.name: tool %q is not defined in tools", choice.Name)
+	default:
+		return fmt.Errorf("tool_choice.type: unsupported value %q", choice.Type)
+	}
+}
+
+// skipToolParsing 请求头 X-No-Tools 为真值时跳过工具调用解析（调试用，便于对比工具层是否改动了输出）
+func skipToolParsing(c *gin.Context) bool {
+	v, err := strconv.ParseBool(c.GetHeader("X-No-Tools"))
+	return err == nil && v
+}
+
+// toolCallFilter 过滤同一响应中的工具调用，流式响应的多个段共用一个过滤器
+// 合并重复的调用（工具名相同且参数语义相同，保留首次出现的顺序），并记录 JSON 经修复后才解析成功的调用
+// 参数先解析再重新序列化后比较，忽略空白和键顺序的差异；dedup_tool_calls 关闭时不合并
+type toolCallFilter struct {
+	rlog *logger.Logger
+	seen map[string]bool
+}
+
+// newToolCallFilter 创建工具调用过滤器
+func newToolCallFilter(rlog *logger.Logger) *toolCallFilter {
+	return &toolCallFilter{rlog: rlog, seen: make(map[string]bool)}
+}
+
+// filter 返回需要下发的工具调用
+func (f *toolCallFilter) filter(calls []toolify.ToolCall) []toolify.ToolCall {
+	dedup := config.Get().DedupToolCalls
+	result := calls[:0:0]
+	for _, call := range calls {
+		if call.Repaired {
+			f.rlog.Warn("[Tools] 工具调用 %s 的 JSON 格式有误，已修复后解析", call.Function.Name)
+		}
+		key := call.Function.Name + "\x00" + normalizeArguments(call.Function.Arguments)
+		if dedup && f.seen[key] {
+			f.rlog.Debug("[Tools] 忽略重复的工具调用: %s", call.Function.Name)
+			continue
+		}
+		f.seen[key] = true
+		result = append(result, call)
+	}
+	return result
+}
+
+// normalizeArguments 规范化工具参数 JSON，无法解析时去除首尾空白后原样比较
+func normalizeArguments(arguments string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(arguments), &v); err != nil {
+		return strings.TrimSpace(arguments)
+	}
+	normalized, _ := json.Marshal(v)
+	return string(normalized)
+}
+
+// toolParser 按 tool_syntaxes 配置创建工具调用解析器
+func toolParser() *toolify.Parser {
+	syntaxes := make([]toolify.Syntax, 0, len(config.Get().ToolSyntaxes))
+	for _, s := range config.Get().ToolSyntaxes {
+		syntaxes = append(syntaxes, toolify.Syntax(s))
+	}
+	return toolify.NewParser(syntaxes...).StripSyntax(config.Get().StripToolSyntax)
+}
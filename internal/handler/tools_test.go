@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/toolify"
+)
+
+// runNonStream 以桩上游执行 handleNonStream，返回状态码和 JSON 响应
+func runNonStream(t *testing.T, stub *stubUpstream, tools []toolify.ToolDefinition, stopSequences []string, prefill string) (int, map[string]interface{}) {
+	t.Helper()
+	useUpstream(t, stub)
+	c, w := newTestContext(http.MethodPost, "/v1/messages", "")
+	handleNonStream(context.Background(), c, client.CursorChatRequest{Model: "claude-4.5-sonnet"}, "claude-sonnet-4-5", tools, stopSequences, prefill, false, "")
+	return w.Code, decodeJSON(t, w)
+}
+
+func TestResolveToolInputEmpty(t *testing.T) {
+	for _, arguments := range []string{"", "  ", "null"} {
+		input, err := resolveToolInput(nil, "Ping", arguments)
+		if err != nil {
+			t.Fatalf("resolveToolInput(%q) error: %v", arguments, err)
+		}
+		if input == nil || len(input) != 0 {
+			t.Errorf("resolveToolInput(%q) = %#v, want empty object", arguments, input)
+		}
+	}
+}
+
+func TestHandleNonStreamToolCallWithoutInput(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) { cfg.ToolSyntaxes = []string{"vm_tags", "fenced_json"} })
+	tools := []toolify.ToolDefinition{{Name: "Ping"}}
+	stub := &stubUpstream{body: sseBody("```json\n{\"name\": \"Ping\", \"input\": null}\n```")}
+
+	status, body := runNonStream(t, stub, tools, nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body = %v", status, body)
+	}
+	content := body["content"].([]interface{})
+	block := content[len(content)-1].(map[string]interface{})
+	if block["type"] != "tool_use" || block["name"] != "Ping" {
+		t.Fatalf("last block = %v, want Ping tool_use", block)
+	}
+	if input, ok := block["input"].(map[string]interface{}); !ok || len(input) != 0 {
+		t.Errorf("input = %#v, want {}", block["input"])
+	}
+}
+
+func TestHandleNonStreamMissingRequiredInputError(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) { cfg.EmptyToolInput = emptyToolInputError })
+	tools := []toolify.ToolDefinition{{
+		Name:        "Bash",
+		InputSchema: map[string]interface{}{"required": []interface{}{"command", "description"}},
+	}}
+	stub := &stubUpstream{body: sseBody("<vm_exec>ls</vm_exec>")}
+
+	status, body := runNonStream(t, stub, tools, nil, "")
+	if status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", status)
+	}
+	errBody, _ := body["error"].(map[string]interface{})
+	if body["type"] != "error" || errBody["type"] != "api_error" || errBody["message"] == "" {
+		t.Errorf("body = %v, want Anthropic api_error envelope", body)
+	}
+}
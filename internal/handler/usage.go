@@ -0,0 +1,177 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/gif"  // 注册 GIF 解码器，用于读取图片尺寸
+	_ "image/jpeg" // 注册 JPEG 解码器
+	_ "image/png"  // 注册 PNG 解码器
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/metrics"
+	"cursor2api/internal/middleware"
+	"cursor2api/internal/tokenizer"
+	"cursor2api/internal/toolify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordTokens 记录本次请求的 token 用量：写入指标，并交给速率限制中间件扣减客户端的 token 配额
+func recordTokens(c *gin.Context, model string, input, output int) {
+	metrics.Tokens(model, input, output)
+	c.Set(middleware.UsageTokensKey, input+output)
+}
+
+// countInputTokens 计算发往 Cursor 的请求中所有消息的 token 数
+// 请求已包含系统提示与注入的工具提示词，因此工具定义也会被计入
+func countInputTokens(req client.CursorChatRequest) int {
+	total := 0
+	for _, msg := range req.Messages {
+		for _, part := range msg.Parts {
+			total += tokenizer.CountForModel(part.Text, req.Model)
+		}
+	}
+	return total
+}
+
+// countOutputTokens 计算响应内容块的 token 数（文本 + 序列化后的工具输入）
+func countOutputTokens(blocks []ContentBlock, model string) int {
+	total := 0
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			total += tokenizer.CountForModel(block.Text, model)
+		case "thinking":
+			total += tokenizer.CountForModel(block.Thinking, model)
+		case "tool_use":
+			inputJSON, _ := json.Marshal(block.Input)
+			total += tokenizer.CountForModel(block.Name, model) + tokenizer.CountForModel(string(inputJSON), model)
+		}
+	}
+	return total
+}
+
+// 图片 token 估算（与 Anthropic 的计算方式一致）：约 宽×高/750，长边超过 maxImageEdge 或像素数超过 maxImagePixels 时先等比缩小
+// 无法得知尺寸的图片（URL、无法解析的数据）按缩小后的最大尺寸计算
+const (
+	imagePixelsPerToken = 750
+	maxImageEdge        = 1568
+	maxImagePixels      = 1_150_000
+	defaultImageTokens  = maxImagePixels / imagePixelsPerToken
+)
+
+// countToolTokens 计算工具定义（名称、描述和参数 schema 序列化后的 JSON）的 token 数
+func countToolTokens(tools []toolify.ToolDefinition, model string) int {
+	total := 0
+	for _, tool := range tools {
+		schema, _ := json.Marshal(tool.GetParameters())
+		total += tokenizer.CountForModel(tool.GetName(), model) +
+			tokenizer.CountForModel(tool.GetDescription(), model) +
+			tokenizer.CountForModel(string(schema), model)
+	}
+	return total
+}
+
+// countImageTokens 估算消息中所有图片（含 tool_result 中的图片）的 token 数，返回 token 数和图片数
+func countImageTokens(messages []Message) (tokens, images int) {
+	var walk func(content interface{})
+	walk = func(content interface{}) {
+		blocks, ok := content.([]interface{})
+		if !ok {
+			return
+		}
+		for _, item := range blocks {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "image":
+				tokens += imageTokens(block)
+				images++
+			case "tool_result":
+				walk(block["content"])
+			}
+		}
+	}
+	for _, msg := range messages {
+		walk(msg.Content)
+	}
+	return tokens, images
+}
+
+// imageTokens 估算单张图片的 token 数
+// 尺寸优先取块或 source 上声明的 width/height，其次从 base64 数据的文件头读取（PNG/JPEG/GIF）
+func imageTokens(block map[string]interface{}) int {
+	source, _ := block["source"].(map[string]interface{})
+	width, height := declaredImageSize(block)
+	if width <= 0 || height <= 0 {
+		width, height = declaredImageSize(source)
+	}
+	if (width <= 0 || height <= 0) && source["type"] == "base64" {
+		data, _ := source["data"].(string)
+		if cfg, _, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))); err == nil {
+			width, height = cfg.Width, cfg.Height
+		}
+	}
+	if width <= 0 || height <= 0 {
+		return defaultImageTokens
+	}
+
+	w, h := float64(width), float64(height)
+	if scale := float64(maxImageEdge) / max(w, h); scale < 1 {
+		w, h = w*scale, h*scale
+	}
+	if pixels := w * h; pixels > maxImagePixels {
+		return defaultImageTokens
+	}
+	return max(int(w*h/imagePixelsPerToken), 1)
+}
+
+// declaredImageSize 读取声明的 width/height（JSON 数字）
+func declaredImageSize(m map[string]interface{}) (int, int) {
+	width, _ := m["width"].(float64)
+	height, _ := m["height"].(float64)
+	return int(width), int(height)
+}
+
+// outputTokenEstimate 流式响应中按已下发的增量滚动估算 output_tokens
+// 逐段计数的结果与整体计数略有偏差，结束时以 countOutputTokens 的结果为准
+type outputTokenEstimate struct {
+	model    string
+	interval int
+	total    int
+	reported int
+}
+
+// newOutputTokenEstimate 创建估算器，interval<=0 时不报告中间值
+func newOutputTokenEstimate(model string, interval int) *outputTokenEstimate {
+	return &outputTokenEstimate{model: model, interval: interval}
+}
+
+// Add 累计一段输出，自上次报告后增加达到 interval 时返回当前估算值和 true
+func (e *outputTokenEstimate) Add(text string) (int, bool) {
+	if e.interval <= 0 || text == "" {
+		return 0, false
+	}
+	e.total += tokenizer.CountForModel(text, e.model)
+	if e.total-e.reported < e.interval {
+		return 0, false
+	}
+	e.reported = e.total
+	return e.total, true
+}
+
+// countToolUses 统计内容块中的工具调用数
+func countToolUses(blocks []ContentBlock) int {
+	n := 0
+	for _, block := range blocks {
+		if block.Type == "tool_use" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// nonStreamUsage 以桩上游发送非流式请求，返回响应中的 usage
+func nonStreamUsage(t *testing.T, prompt, response string) (input, output int) {
+	t.Helper()
+	body := fmt.Sprintf(`{"model": "claude-sonnet-4-5", "max_tokens": 4096, "stream": false, "messages": [{"role": "user", "content": %q}]}`, prompt)
+	w := postMessages(t, &stubUpstream{body: sseBody(response)}, body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	usage := decodeJSON(t, w)["usage"].(map[string]interface{})
+	return int(usage["input_tokens"].(float64)), int(usage["output_tokens"].(float64))
+}
+
+func TestNonStreamUsageReflectsContent(t *testing.T) {
+	shortIn, shortOut := nonStreamUsage(t, "hi", "Hello!")
+	longIn, longOut := nonStreamUsage(t, strings.Repeat("Tell me a long story. ", 50), strings.Repeat("Once upon a time there was a proxy. ", 40))
+
+	if shortOut <= 0 || shortIn <= 0 {
+		t.Fatalf("short usage = %d/%d, want positive counts", shortIn, shortOut)
+	}
+	if longOut <= shortOut*10 {
+		t.Errorf("output_tokens short=%d long=%d, want the long response to count far more", shortOut, longOut)
+	}
+	if longIn <= shortIn {
+		t.Errorf("input_tokens short=%d long=%d, want the long prompt to count more", shortIn, longIn)
+	}
+	if shortIn == 100 && shortOut == 100 {
+		t.Error("usage still reports the old hard-coded 100/100")
+	}
+}
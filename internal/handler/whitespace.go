@@ -0,0 +1,66 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"strings"
+	"unicode"
+
+	"cursor2api/internal/config"
+)
+
+// whitespaceCollapser 合并流式增量中的连续空白
+// 默认关闭（逐字节原样下发，保证代码块和缩进不变）；开启后连续空白合并为一个空格，
+// 含换行的空白合并为一个换行。跨 delta 的空白也会被合并
+type whitespaceCollapser struct {
+	enabled    bool
+	pendingNL  bool // 当前空白段中是否含换行
+	pendingRun bool // 是否有尚未下发的空白段
+}
+
+// newWhitespaceCollapser 按配置创建空白合并器
+func newWhitespaceCollapser() *whitespaceCollapser {
+	return &whitespaceCollapser{enabled: config.Get().CollapseDeltaWhitespace}
+}
+
+// Apply 处理一段增量；空白段延迟到下一个非空白字符时下发，以便跨 delta 合并
+func (w *whitespaceCollapser) Apply(delta string) string {
+	if !w.enabled {
+		return delta
+	}
+	var b strings.Builder
+	for _, r := range delta {
+		if unicode.IsSpace(r) {
+			w.pendingRun = true
+			if r == '\n' {
+				w.pendingNL = true
+			}
+			continue
+		}
+		w.writePending(&b)
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Flush 流结束时下发剩余的空白段
+func (w *whitespaceCollapser) Flush() string {
+	if !w.enabled {
+		return ""
+	}
+	var b strings.Builder
+	w.writePending(&b)
+	return b.String()
+}
+
+// writePending 写出合并后的空白段
+func (w *whitespaceCollapser) writePending(b *strings.Builder) {
+	if !w.pendingRun {
+		return
+	}
+	if w.pendingNL {
+		b.WriteByte('\n')
+	} else {
+		b.WriteByte(' ')
+	}
+	w.pendingRun, w.pendingNL = false, false
+}
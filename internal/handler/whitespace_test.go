@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+const indentedCode = "Here is the fix:\n\n```go\nfunc main() {\n\tif ok {\n\t\tfmt.Println(\"  two  spaces  \")\n\t}\n}\n```\n\n    indented line\n"
+
+// splitEvery 将文本按固定字节数切成 delta（模拟上游任意的分块边界）
+func splitEvery(text string, n int) []string {
+	var deltas []string
+	for len(text) > n {
+		deltas = append(deltas, text[:n])
+		text = text[n:]
+	}
+	return append(deltas, text)
+}
+
+func TestStreamPreservesWhitespaceByDefault(t *testing.T) {
+	for _, size := range []int{1, 3, 7} {
+		// 停止序列的保留缓冲和工具调用切分器都会重新分块，下发的文本仍须逐字节一致
+		stub := &stubUpstream{batches: [][]client.CursorEvent{textEvents(splitEvery(indentedCode, size)...)}}
+		events := runStream(t, stub, writeTool, []string{"<<END>>"})
+		if got := streamedText(events); got != indentedCode {
+			t.Errorf("chunk size %d: text = %q, want byte-exact %q", size, got, indentedCode)
+		}
+	}
+}
+
+func TestWhitespaceCollapserOptIn(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) { cfg.CollapseDeltaWhitespace = true })
+	w := newWhitespaceCollapser()
+	var got string
+	for _, delta := range []string{"a  ", "  b\n", "\n  c", "   "} {
+		got += w.Apply(delta)
+	}
+	got += w.Flush()
+	if want := "a b\nc "; got != want {
+		t.Errorf("collapsed = %q, want %q", got, want)
+	}
+}
@@ -117,6 +117,14 @@ func (l *Logger) WithPrefix(prefix string) *Logger {
 	return newLogger
 }
 
+// With 返回附带结构化字段的日志器（键值对交替传入），字段会写入每条日志
+func (l *Logger) With(keysAndValues ...any) *Logger {
+	return &Logger{
+		zap:    l.zap.With(keysAndValues...),
+		prefix: l.prefix,
+	}
+}
+
 func (l *Logger) format(msg string) string {
 	if l.prefix != "" {
 		return fmt.Sprintf("[%s] %s", l.prefix, msg)
@@ -0,0 +1,136 @@
+// Package metrics 提供 Prometheus 监控指标
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cursor2api"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "请求总数（按接口、Cursor 模型、是否流式）",
+	}, []string{"endpoint", "model", "stream"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "请求处理耗时（秒）",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"endpoint", "model", "stream"})
+
+	upstreamErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Cursor 上游请求失败次数（重试后仍失败）",
+	}, []string{"model"})
+
+	upstreamAccountHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_account_healthy",
+		Help:      "上游账号是否可用（1 可用，0 冷却中）",
+	}, []string{"account"})
+
+	upstreamAccountFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_account_failures_total",
+		Help:      "上游账号被限流或鉴权失败的次数（status=429/401/403）",
+	}, []string{"account", "status"})
+
+	toolCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tool_calls_total",
+		Help:      "返回给客户端的工具调用数",
+	}, []string{"model"})
+
+	tokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "累计 token 数（type=input/output）",
+	}, []string{"model", "type"})
+
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_requests",
+		Help:      "正在处理的请求数（受并发限制的接口）",
+	})
+
+	queuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queued_requests",
+		Help:      "等待并发名额的请求数",
+	})
+
+	rejectedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_requests_total",
+		Help:      "因并发或速率限制被拒绝的请求数（reason=queue_full/queue_timeout/rate_limit_requests/rate_limit_tokens）",
+	}, []string{"reason"})
+)
+
+// Handler 返回 /metrics 处理器
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// ObserveRequest 记录一次请求及其耗时
+func ObserveRequest(endpoint, model string, stream bool, start time.Time) {
+	labels := prometheus.Labels{"endpoint": endpoint, "model": model, "stream": strconv.FormatBool(stream)}
+	requestsTotal.With(labels).Inc()
+	requestDuration.With(labels).Observe(time.Since(start).Seconds())
+}
+
+// UpstreamError 记录一次上游请求失败
+func UpstreamError(model string) {
+	upstreamErrorsTotal.WithLabelValues(model).Inc()
+}
+
+// AccountHealthy 设置上游账号是否可用
+func AccountHealthy(account string, healthy bool) {
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	upstreamAccountHealthy.WithLabelValues(account).Set(v)
+}
+
+// AccountFailure 记录一次上游账号被限流或鉴权失败
+func AccountFailure(account string, status int) {
+	upstreamAccountFailuresTotal.WithLabelValues(account, strconv.Itoa(status)).Inc()
+}
+
+// ToolCalls 记录返回的工具调用数
+func ToolCalls(model string, n int) {
+	if n > 0 {
+		toolCallsTotal.WithLabelValues(model).Add(float64(n))
+	}
+}
+
+// Tokens 记录输入/输出 token 数
+func Tokens(model string, input, output int) {
+	tokensTotal.WithLabelValues(model, "input").Add(float64(input))
+	tokensTotal.WithLabelValues(model, "output").Add(float64(output))
+}
+
+// InFlight 调整正在处理的请求数
+func InFlight(delta int) {
+	inFlightRequests.Add(float64(delta))
+}
+
+// Queued 调整排队中的请求数
+func Queued(delta int) {
+	queuedRequests.Add(float64(delta))
+}
+
+// Rejected 记录一次因并发或速率限制被拒绝的请求
+func Rejected(reason string) {
+	rejectedRequestsTotal.WithLabelValues(reason).Inc()
+}
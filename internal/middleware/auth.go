@@ -0,0 +1,77 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+var log = logger.Get().WithPrefix("Auth")
+
+// APIKeyKey gin.Context 中保存通过鉴权的 API Key 的键（未启用鉴权时不设置）
+const APIKeyKey = "api_key"
+
+// Auth API Key 鉴权中间件
+// 从 x-api-key 或 Authorization: Bearer 读取 Key，与配置的 api_keys 逐个做常量时间比较
+// 未配置任何 Key 时不鉴权（兼容旧部署）
+func Auth() gin.HandlerFunc {
+	keys := config.Get().APIKeys
+	if len(keys) == 0 {
+		log.Warn("未配置 api_keys，接口不鉴权")
+		return func(c *gin.Context) { c.Next() }
+	}
+	log.Info("已启用 API Key 鉴权, Key 数量: %d", len(keys))
+
+	return func(c *gin.Context) {
+		key := requestAPIKey(c)
+		if key == "" {
+			abortUnauthorized(c, "missing API key: set the x-api-key or Authorization header")
+			return
+		}
+		if !matchAPIKey(keys, key) {
+			log.Warn("API Key 校验失败, 来源: %s", c.ClientIP())
+			abortUnauthorized(c, "invalid API key")
+			return
+		}
+		c.Set(APIKeyKey, key)
+		c.Next()
+	}
+}
+
+// requestAPIKey 从请求头读取 API Key
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("x-api-key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// matchAPIKey 常量时间比较，遍历全部 Key，避免通过耗时推断匹配位置
+func matchAPIKey(keys []string, key string) bool {
+	matched := 0
+	for _, k := range keys {
+		matched |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+	}
+	return matched == 1
+}
+
+// abortUnauthorized 返回 Anthropic 格式的 401 错误
+func abortUnauthorized(c *gin.Context, message string) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "authentication_error",
+			"message": message,
+		},
+	})
+}
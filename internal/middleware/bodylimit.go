@@ -0,0 +1,36 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"cursor2api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimit 请求体大小限制中间件
+// Content-Length 超过 max_body_bytes 时直接返回 413；否则用 MaxBytesReader 包装请求体，
+// 读取超限时解析失败，由处理器返回 413，避免超大请求在解析时耗尽内存
+func BodyLimit() gin.HandlerFunc {
+	limit := config.Get().RequestLimits.MaxBodyBytes
+	if limit <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"type": "error",
+				"error": gin.H{
+					"type":    "request_too_large",
+					"message": fmt.Sprintf("request body exceeds the maximum size of %d bytes", limit),
+				},
+			})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
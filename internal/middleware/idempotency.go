@@ -0,0 +1,202 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+var idempotencyLog = logger.Get().WithPrefix("Idempotency")
+
+// IdempotencyKey gin.Context 中保存 ID 派生种子的键（请求携带 Idempotency-Key 时设置）
+const IdempotencyKey = "idempotency_key"
+
+// IdempotencyDoneKey 处理器成功写完响应后在 gin.Context 中设置的键，只有设置了该键的响应才会缓存
+// 流式响应的状态码始终为 200，需要处理器明确标记（以 error 事件结束的流不缓存）
+const IdempotencyDoneKey = "idempotency_done"
+
+// idempotencyHeader 客户端提供幂等键的请求头
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength 幂等键最大长度，超过时返回 400
+const maxIdempotencyKeyLength = 255
+
+// idempotencyEntry 单个幂等键的缓存条目
+type idempotencyEntry struct {
+	bodyHash    [sha256.Size]byte
+	done        bool // 响应已缓存；为 false 时首次请求仍在处理
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache 幂等键 -> 响应的短期缓存
+type idempotencyCache struct {
+	mu         sync.Mutex
+	entries    map[string]*idempotencyEntry
+	ttl        time.Duration
+	maxEntries int
+}
+
+// Idempotency Idempotency-Key 中间件（用于 Messages / Chat Completions）
+// 请求携带 Idempotency-Key 时：按键派生确定性 ID 种子保存到 gin.Context；
+// 成功的响应缓存 ttl_seconds 秒，重复提交（请求体相同）直接返回缓存结果；
+// 首次请求仍在处理时返回 409，请求体不同时返回 422
+// 键按接口路径和 API Key 隔离，不同客户端使用相同的键不会互相影响
+func Idempotency() gin.HandlerFunc {
+	cfg := config.Get().Idempotency
+	if !cfg.Enabled {
+		return func(c *gin.Context) { c.Next() }
+	}
+	cache := &idempotencyCache{
+		entries:    make(map[string]*idempotencyEntry),
+		ttl:        time.Duration(cfg.TTLSeconds) * time.Second,
+		maxEntries: cfg.MaxEntries,
+	}
+	idempotencyLog.Info("已启用 Idempotency-Key: 缓存 %ds, 最多 %d 条", cfg.TTLSeconds, cfg.MaxEntries)
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			abortIdempotency(c, http.StatusBadRequest, "invalid_request_error", "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				abortIdempotency(c, http.StatusRequestEntityTooLarge, "request_too_large", err.Error())
+				return
+			}
+			abortIdempotency(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := scopedIdempotencyKey(c, key)
+		bodyHash := sha256.Sum256(body)
+		entry, existing := cache.begin(scope, bodyHash)
+		if existing {
+			switch {
+			case entry.bodyHash != bodyHash:
+				abortIdempotency(c, http.StatusUnprocessableEntity, "invalid_request_error", "Idempotency-Key has already been used with a different request body")
+			case !entry.done:
+				abortIdempotency(c, http.StatusConflict, "invalid_request_error", "a request with the same Idempotency-Key is still being processed")
+			default:
+				idempotencyLog.Debug("重复提交，返回缓存的响应: request_id=%s", c.GetString(RequestIDKey))
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(entry.status, entry.contentType, entry.body)
+				c.Abort()
+			}
+			return
+		}
+
+		c.Set(IdempotencyKey, scope)
+		recorder := NewRecordingWriter(c.Writer)
+		c.Writer = recorder
+		c.Next()
+
+		if !c.GetBool(IdempotencyDoneKey) || recorder.Status() != http.StatusOK || c.Request.Context().Err() != nil {
+			cache.forget(scope)
+			return
+		}
+		cache.store(scope, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.Body())
+	}
+}
+
+// scopedIdempotencyKey 将幂等键与接口路径、API Key 组合后取哈希，作为缓存键和 ID 派生种子
+func scopedIdempotencyKey(c *gin.Context, key string) string {
+	h := sha256.New()
+	for _, part := range []string{c.FullPath(), requestAPIKey(c), key} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// begin 查找幂等键；不存在（或已过期）时登记为处理中，返回 existing=false
+func (ic *idempotencyCache) begin(key string, bodyHash [sha256.Size]byte) (entry *idempotencyEntry, existing bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := ic.entries[key]; ok && (!entry.done || now.Before(entry.expires)) {
+		return entry, true
+	}
+	ic.evict(now)
+	ic.entries[key] = &idempotencyEntry{bodyHash: bodyHash}
+	return nil, false
+}
+
+// store 缓存成功的响应
+func (ic *idempotencyCache) store(key string, status int, contentType string, body []byte) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	entry, ok := ic.entries[key]
+	if !ok {
+		return
+	}
+	entry.done = true
+	entry.status = status
+	entry.contentType = contentType
+	entry.body = bytes.Clone(body)
+	entry.expires = time.Now().Add(ic.ttl)
+}
+
+// forget 删除处理失败的请求的登记，允许客户端用同一个键重试
+func (ic *idempotencyCache) forget(key string) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	delete(ic.entries, key)
+}
+
+// evict 清理过期条目；仍达到 max_entries 时淘汰最早过期的已完成条目（调用方持有锁）
+func (ic *idempotencyCache) evict(now time.Time) {
+	for key, entry := range ic.entries {
+		if entry.done && !now.Before(entry.expires) {
+			delete(ic.entries, key)
+		}
+	}
+	for ic.maxEntries > 0 && len(ic.entries) >= ic.maxEntries {
+		oldest := ""
+		for key, entry := range ic.entries {
+			if entry.done && (oldest == "" || entry.expires.Before(ic.entries[oldest].expires)) {
+				oldest = key
+			}
+		}
+		// 全部是处理中的请求：不淘汰，暂时超出上限
+		if oldest == "" {
+			return
+		}
+		delete(ic.entries, oldest)
+	}
+}
+
+// abortIdempotency 返回 Anthropic 格式的错误
+func abortIdempotency(c *gin.Context, status int, errType, message string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
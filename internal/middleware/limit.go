@@ -0,0 +1,101 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+	"cursor2api/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+var limitLog = logger.Get().WithPrefix("Limit")
+
+// ConcurrencyLimit 并发请求限制中间件
+// 同时处理的请求数达到 max_in_flight 后排队等待，队列满或排队超时返回 429 rate_limit_error
+// 所有使用该中间件的路由共享同一组名额
+func ConcurrencyLimit() gin.HandlerFunc {
+	cfg := config.Get().Concurrency
+	if cfg.MaxInFlight <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	limitLog.Info("已启用并发限制: 最大并发 %d, 最大排队 %d, 排队超时 %dms", cfg.MaxInFlight, cfg.MaxQueue, cfg.QueueTimeoutMs)
+
+	slots := make(chan struct{}, cfg.MaxInFlight)
+	queueTimeout := time.Duration(cfg.QueueTimeoutMs) * time.Millisecond
+	var queued atomic.Int64
+
+	return func(c *gin.Context) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if queued.Add(1) > int64(cfg.MaxQueue) {
+				queued.Add(-1)
+				metrics.Rejected("queue_full")
+				limitLog.Warn("并发已满且排队已满（%d），拒绝请求, 来源: %s", cfg.MaxQueue, c.ClientIP())
+				abortRateLimited(c, queueTimeout, "too many concurrent requests, please retry later")
+				return
+			}
+			metrics.Queued(1)
+			ok := waitSlot(c, slots, queueTimeout)
+			queued.Add(-1)
+			metrics.Queued(-1)
+			if !ok {
+				if c.Request.Context().Err() == nil {
+					metrics.Rejected("queue_timeout")
+					limitLog.Warn("排队超过 %v 仍无空闲名额，拒绝请求, 来源: %s", queueTimeout, c.ClientIP())
+					abortRateLimited(c, queueTimeout, fmt.Sprintf("request queued for more than %v, please retry later", queueTimeout))
+				} else {
+					c.Abort()
+				}
+				return
+			}
+		}
+
+		metrics.InFlight(1)
+		defer func() {
+			<-slots
+			metrics.InFlight(-1)
+		}()
+		c.Next()
+	}
+}
+
+// waitSlot 排队等待并发名额，超时或客户端断开时返回 false
+func waitSlot(c *gin.Context, slots chan struct{}, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-expired:
+		return false
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// abortRateLimited 返回 Anthropic 格式的 429 错误
+func abortRateLimited(c *gin.Context, retryAfter time.Duration, message string) {
+	if seconds := int(retryAfter.Seconds()); seconds > 0 {
+		c.Header("Retry-After", strconv.Itoa(seconds))
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "rate_limit_error",
+			"message": message,
+		},
+	})
+}
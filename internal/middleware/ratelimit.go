@@ -0,0 +1,195 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UsageTokensKey 处理器在 gin.Context 中记录本次请求实际消耗的 token 数（输入 + 输出）的键，用于扣减 token 配额
+const UsageTokensKey = "usage_tokens"
+
+// rateLimitSweepInterval 清理空闲客户端令牌桶的间隔
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket 令牌桶：容量为每分钟配额，按秒匀速补充；余额可以为负（token 用量在请求结束后才扣减）
+type tokenBucket struct {
+	balance float64
+	rate    float64 // 每秒补充量
+	limit   float64 // 容量
+	updated time.Time
+}
+
+// refill 按经过的时间补充余额
+func (b *tokenBucket) refill(now time.Time) {
+	b.balance = math.Min(b.limit, b.balance+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+// wait 余额达到 need 还需等待的时间
+func (b *tokenBucket) wait(need float64) time.Duration {
+	if b.balance >= need {
+		return 0
+	}
+	return time.Duration((need - b.balance) / b.rate * float64(time.Second))
+}
+
+// clientBuckets 单个客户端的请求数和 token 令牌桶（未配置的限制为 nil）
+type clientBuckets struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+// rateLimiter 按客户端区分的令牌桶集合
+type rateLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientBuckets
+	rpm       int
+	tpm       int
+	lastSweep time.Time
+}
+
+// RateLimit 按客户端限制请求速率和 token 用量的中间件
+// 客户端按 API Key 区分（未启用鉴权时按 IP）；requests_per_minute 限制请求数，tokens_per_minute 限制输入 + 输出 token 数
+// token 用量在请求结束后按处理器记录的实际值扣减，余额为负时拒绝后续请求直到补充回零
+// 超出限制时返回 429 rate_limit_error，Retry-After 为恢复所需的秒数
+func RateLimit() gin.HandlerFunc {
+	cfg := config.Get().RateLimit
+	if cfg.RequestsPerMinute <= 0 && cfg.TokensPerMinute <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	limitLog.Info("已启用客户端速率限制: 每分钟请求数 %d, 每分钟 token 数 %d（0 为不限制）", cfg.RequestsPerMinute, cfg.TokensPerMinute)
+
+	limiter := &rateLimiter{
+		clients:   make(map[string]*clientBuckets),
+		rpm:       cfg.RequestsPerMinute,
+		tpm:       cfg.TokensPerMinute,
+		lastSweep: time.Now(),
+	}
+
+	return func(c *gin.Context) {
+		key := rateLimitClient(c)
+		if retryAfter, reason := limiter.take(key); retryAfter > 0 {
+			metrics.Rejected(reason)
+			limitLog.Warn("客户端超出速率限制（%s），%v 后可重试, 来源: %s", reason, retryAfter, c.ClientIP())
+			// Retry-After 向上取整，至少 1 秒
+			abortRateLimited(c, time.Duration(math.Ceil(retryAfter.Seconds()))*time.Second, rateLimitMessage(reason, cfg))
+			return
+		}
+
+		c.Next()
+
+		if tokens := c.GetInt(UsageTokensKey); tokens > 0 {
+			limiter.debit(key, tokens)
+		}
+	}
+}
+
+// rateLimitClient 限流使用的客户端标识：通过鉴权的 API Key，未启用鉴权时为客户端 IP
+func rateLimitClient(c *gin.Context) string {
+	if key := c.GetString(APIKeyKey); key != "" {
+		return "key:" + key
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// rateLimitMessage 429 错误信息
+func rateLimitMessage(reason string, cfg config.RateLimitConfig) string {
+	if reason == "rate_limit_tokens" {
+		return fmt.Sprintf("token rate limit exceeded (%d tokens per minute), please retry later", cfg.TokensPerMinute)
+	}
+	return fmt.Sprintf("request rate limit exceeded (%d requests per minute), please retry later", cfg.RequestsPerMinute)
+}
+
+// take 检查客户端配额并消耗一次请求；超出限制时返回需要等待的时间和原因（不消耗配额）
+func (l *rateLimiter) take(key string) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	b := l.buckets(key, now)
+
+	if b.tokens != nil {
+		b.tokens.refill(now)
+		// 余额不为负即可发起请求，实际用量在请求结束后扣减
+		if wait := b.tokens.wait(0); wait > 0 {
+			return wait, "rate_limit_tokens"
+		}
+	}
+	if b.requests != nil {
+		b.requests.refill(now)
+		if wait := b.requests.wait(1); wait > 0 {
+			return wait, "rate_limit_requests"
+		}
+		b.requests.balance--
+	}
+	return 0, ""
+}
+
+// debit 扣减客户端的 token 配额
+func (l *rateLimiter) debit(key string, tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b := l.buckets(key, now)
+	if b.tokens != nil {
+		b.tokens.refill(now)
+		b.tokens.balance -= float64(tokens)
+	}
+}
+
+// buckets 取得客户端的令牌桶，首次出现时创建（初始为满）（调用方持有锁）
+func (l *rateLimiter) buckets(key string, now time.Time) *clientBuckets {
+	if b, ok := l.clients[key]; ok {
+		return b
+	}
+	b := &clientBuckets{}
+	if l.rpm > 0 {
+		b.requests = newTokenBucket(l.rpm, now)
+	}
+	if l.tpm > 0 {
+		b.tokens = newTokenBucket(l.tpm, now)
+	}
+	l.clients[key] = b
+	return b
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		balance: float64(perMinute),
+		rate:    float64(perMinute) / 60,
+		limit:   float64(perMinute),
+		updated: now,
+	}
+}
+
+// sweep 定期删除已补满的令牌桶（与新建的桶等价），避免客户端数量无限增长（调用方持有锁）
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.clients {
+		if full(b.requests, now) && full(b.tokens, now) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// full 令牌桶在 now 时是否已补满（未配置的限制视为已满）
+func full(b *tokenBucket, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.balance >= b.limit
+}
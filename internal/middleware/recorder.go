@@ -0,0 +1,35 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"bytes"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RecordingWriter 在写出响应的同时记录响应体，流式响应逐块累积
+// 用于幂等缓存和请求抓取
+type RecordingWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+// NewRecordingWriter 包装 w，之后写入的响应体同时被记录
+func NewRecordingWriter(w gin.ResponseWriter) *RecordingWriter {
+	return &RecordingWriter{ResponseWriter: w}
+}
+
+func (w *RecordingWriter) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *RecordingWriter) WriteString(s string) (int, error) {
+	w.buf.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Body 返回已记录的响应体
+func (w *RecordingWriter) Body() []byte {
+	return w.buf.Bytes()
+}
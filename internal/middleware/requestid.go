@@ -0,0 +1,28 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDKey gin.Context 中保存请求 ID 的键
+const RequestIDKey = "request_id"
+
+// requestIDHeader 请求 ID 响应头（客户端传入时沿用）
+const requestIDHeader = "X-Request-Id"
+
+// RequestID 为每个请求生成请求 ID，写入 X-Request-Id 响应头并保存到 gin.Context
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = "req_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
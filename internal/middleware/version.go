@@ -0,0 +1,67 @@
+// Package middleware 提供 gin 中间件
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cursor2api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnthropicVersionKey gin.Context 中保存协商后的 anthropic-version 的键
+const AnthropicVersionKey = "anthropic_version"
+
+// AnthropicBetaKey gin.Context 中保存客户端请求的 anthropic-beta 特性列表的键
+const AnthropicBetaKey = "anthropic_beta"
+
+// AnthropicVersion anthropic-version 协商中间件（用于 Anthropic 接口）
+// 请求头中的版本必须在 anthropic_versions 中，否则返回 400；未携带时使用列表中的第一个版本
+// 协商结果写入 anthropic-version 响应头；anthropic-beta 解析后保存到 gin.Context
+func AnthropicVersion() gin.HandlerFunc {
+	supported := config.Get().AnthropicVersions
+
+	return func(c *gin.Context) {
+		version := strings.TrimSpace(c.GetHeader("anthropic-version"))
+		if version == "" && len(supported) > 0 {
+			version = supported[0]
+		}
+		if len(supported) > 0 && !containsString(supported, version) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"type": "error",
+				"error": gin.H{
+					"type":    "invalid_request_error",
+					"message": fmt.Sprintf("anthropic-version: %q is not a supported version, supported versions: %s", version, strings.Join(supported, ", ")),
+				},
+			})
+			return
+		}
+		if version != "" {
+			c.Set(AnthropicVersionKey, version)
+			c.Header("anthropic-version", version)
+		}
+
+		if beta := c.GetHeader("anthropic-beta"); beta != "" {
+			var features []string
+			for _, feature := range strings.Split(beta, ",") {
+				if feature = strings.TrimSpace(feature); feature != "" {
+					features = append(features, feature)
+				}
+			}
+			c.Set(AnthropicBetaKey, features)
+		}
+		c.Next()
+	}
+}
+
+// containsString 判断切片中是否包含指定字符串
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
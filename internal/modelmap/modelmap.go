@@ -0,0 +1,198 @@
+// Package modelmap 提供客户端模型名到 Cursor 模型名的映射
+// 映射表可从 JSON/YAML 文件加载，无需重新编译即可跟进 Cursor 的模型变更
+package modelmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+var log = logger.Get().WithPrefix("ModelMap")
+
+// DefaultModel 没有任何规则命中时使用的 Cursor 模型
+const DefaultModel = "claude-opus-4-5-20251101"
+
+// File 模型映射文件格式（JSON 或 YAML）
+type File struct {
+	// Default 未命中任何规则时使用的 Cursor 模型
+	Default string `yaml:"default" json:"default"`
+	// Exact 精确匹配表，优先级高于子串匹配
+	Exact map[string]string `yaml:"exact" json:"exact"`
+	// Patterns 子串匹配表（如 "claude" -> "claude-opus-4-5-20251101"），较长的子串优先
+	Patterns map[string]string `yaml:"patterns" json:"patterns"`
+}
+
+// patternRule 子串匹配规则
+type patternRule struct {
+	pattern string
+	target  string
+}
+
+// ModelMapper 模型映射器
+// 匹配顺序：精确匹配 -> 子串匹配 -> 默认模型，匹配均忽略大小写
+type ModelMapper struct {
+	aliases      []string // 精确匹配表中的原始模型名
+	exact        map[string]string
+	patterns     []patternRule
+	defaultModel string
+	normalize    bool
+}
+
+var (
+	instance *ModelMapper
+	once     sync.Once
+)
+
+// Get 获取全局模型映射器（首次调用时根据配置加载映射文件）
+func Get() *ModelMapper {
+	once.Do(func() {
+		cfg := config.Get()
+		file := File{}
+		if cfg.ModelMapFile != "" {
+			loaded, err := Load(cfg.ModelMapFile)
+			if err != nil {
+				log.Error("加载模型映射文件失败: %v", err)
+			} else {
+				file = loaded
+				log.Info("已加载模型映射文件 %s (精确: %d, 子串: %d)", cfg.ModelMapFile, len(file.Exact), len(file.Patterns))
+			}
+		}
+		// config.yaml 中的 model_map 作为精确匹配表，覆盖文件中的同名条目
+		if len(cfg.ModelMap) > 0 {
+			if file.Exact == nil {
+				file.Exact = make(map[string]string, len(cfg.ModelMap))
+			}
+			for from, to := range cfg.ModelMap {
+				file.Exact[from] = to
+			}
+		}
+		instance = New(file, cfg.NormalizeModelNames)
+	})
+	return instance
+}
+
+// Load 从 JSON 或 YAML 文件加载映射表（按扩展名 .json 判断格式）
+func Load(path string) (File, error) {
+	var file File
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, fmt.Errorf("read %s: %w", path, err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return file, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// New 创建模型映射器
+// normalize 为 true 时匹配前统一分隔符（见 Normalize），否则只忽略大小写
+func New(file File, normalize bool) *ModelMapper {
+	m := &ModelMapper{
+		exact:        make(map[string]string, len(file.Exact)),
+		defaultModel: file.Default,
+		normalize:    normalize,
+	}
+	if m.defaultModel == "" {
+		m.defaultModel = DefaultModel
+	}
+	for from, to := range file.Exact {
+		m.exact[m.key(from)] = to
+		m.aliases = append(m.aliases, from)
+	}
+	sort.Strings(m.aliases)
+	for pattern, to := range file.Patterns {
+		m.patterns = append(m.patterns, patternRule{pattern: m.key(pattern), target: to})
+	}
+	// 较长（更具体）的子串优先，长度相同时按字典序保证结果稳定
+	sort.Slice(m.patterns, func(i, j int) bool {
+		if len(m.patterns[i].pattern) != len(m.patterns[j].pattern) {
+			return len(m.patterns[i].pattern) > len(m.patterns[j].pattern)
+		}
+		return m.patterns[i].pattern < m.patterns[j].pattern
+	})
+	return m
+}
+
+// Map 将客户端模型名映射为 Cursor 模型名
+func (m *ModelMapper) Map(model string) string {
+	target, _ := m.Lookup(model)
+	return target
+}
+
+// Lookup 将客户端模型名映射为 Cursor 模型名
+// matched 为 false 表示没有命中任何规则（也不是默认模型本身），返回的是默认模型
+func (m *ModelMapper) Lookup(model string) (target string, matched bool) {
+	key := m.key(model)
+	if target, ok := m.exact[key]; ok {
+		log.Debug("模型映射 (精确): %s -> %s", model, target)
+		return target, true
+	}
+	for _, rule := range m.patterns {
+		if strings.Contains(key, rule.pattern) {
+			log.Debug("模型映射 (子串 %s): %s -> %s", rule.pattern, model, rule.target)
+			return rule.target, true
+		}
+	}
+	if key == m.key(m.defaultModel) {
+		return m.defaultModel, true
+	}
+	log.Debug("模型映射: %s -> %s", model, m.defaultModel)
+	return m.defaultModel, false
+}
+
+// Targets 返回所有已知的 Cursor 模型（默认模型 + 各规则的目标），按名称排序
+func (m *ModelMapper) Targets() []string {
+	seen := map[string]bool{m.defaultModel: true}
+	for _, to := range m.exact {
+		seen[to] = true
+	}
+	for _, rule := range m.patterns {
+		seen[rule.target] = true
+	}
+	targets := make([]string, 0, len(seen))
+	for target := range seen {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Aliases 返回精确匹配表中配置的客户端模型名，按名称排序
+func (m *ModelMapper) Aliases() []string {
+	return append([]string(nil), m.aliases...)
+}
+
+// key 计算匹配用的键
+func (m *ModelMapper) key(model string) string {
+	if m.normalize {
+		return Normalize(model)
+	}
+	return strings.ToLower(strings.TrimSpace(model))
+}
+
+// separatorPattern 匹配模型名中的各类分隔符
+var separatorPattern = regexp.MustCompile(`[\s._-]+`)
+
+// Normalize 规范化模型名称：小写、统一分隔符为 "-"、合并连续空白
+// 例如 "Claude-3.5-Sonnet"、"claude_3_5_sonnet"、"claude 3.5 sonnet" 均得到 "claude-3-5-sonnet"
+func Normalize(model string) string {
+	name := strings.ToLower(strings.TrimSpace(model))
+	name = separatorPattern.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-")
+}
@@ -0,0 +1,58 @@
+package modelmap
+
+import "testing"
+
+func TestLookupNormalizesVariants(t *testing.T) {
+	m := New(File{
+		Default: "default-model",
+		Exact:   map[string]string{"claude-3.5-sonnet": "exact-target"},
+		Patterns: map[string]string{
+			"gpt 4o": "pattern-target",
+		},
+	}, true)
+
+	variants := []string{
+		"claude-3.5-sonnet",
+		"Claude-3.5-Sonnet",
+		"claude_3_5_sonnet",
+		"claude 3.5 sonnet",
+		"  CLAUDE   3.5\tSONNET ",
+		"claude--3..5__sonnet",
+	}
+	for _, v := range variants {
+		if got, matched := m.Lookup(v); got != "exact-target" || !matched {
+			t.Errorf("Lookup(%q) = %q, %v, want exact-target", v, got, matched)
+		}
+	}
+
+	for _, v := range []string{"gpt-4o", "GPT_4o-mini", "openai/gpt 4o"} {
+		if got := m.Map(v); got != "pattern-target" {
+			t.Errorf("Map(%q) = %q, want pattern-target", v, got)
+		}
+	}
+}
+
+func TestLookupWithoutNormalizationOnlyIgnoresCase(t *testing.T) {
+	m := New(File{Exact: map[string]string{"claude-3.5-sonnet": "exact-target"}}, false)
+	if got := m.Map("CLAUDE-3.5-SONNET"); got != "exact-target" {
+		t.Errorf("Map(upper case) = %q, want exact-target", got)
+	}
+	if got, matched := m.Lookup("claude_3_5_sonnet"); matched {
+		t.Errorf("Lookup(underscores) = %q, want no match without normalization", got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"Claude-3.5-Sonnet":   "claude-3-5-sonnet",
+		"claude_3_5_sonnet":   "claude-3-5-sonnet",
+		"claude 3.5 sonnet":   "claude-3-5-sonnet",
+		" claude  3.5 sonnet": "claude-3-5-sonnet",
+		"-gpt-4o-":            "gpt-4o",
+	}
+	for in, want := range tests {
+		if got := Normalize(in); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package tokenizer 提供 token 数量估算
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+
+	"cursor2api/internal/logger"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	encodingCL100K = "cl100k_base"
+	encodingO200K  = "o200k_base"
+)
+
+var (
+	log = logger.Get().WithPrefix("Tokenizer")
+
+	loaderOnce sync.Once
+	mu         sync.Mutex
+	encoders   = make(map[string]*tiktoken.Tiktoken)
+	failed     = make(map[string]bool)
+)
+
+// Count 使用默认编码（cl100k_base）计算文本的 token 数量
+func Count(text string) int {
+	return CountForModel(text, "")
+}
+
+// CountForModel 按模型家族选择 BPE 编码计算文本的 token 数量
+// 编码器无法初始化时回退到 estimate 的字节估算
+func CountForModel(text, model string) int {
+	if text == "" {
+		return 0
+	}
+	enc := encoderFor(encodingForModel(model))
+	if enc == nil {
+		return estimate(text)
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// encodingForModel 根据 Cursor 模型名选择编码
+// GPT-4o / GPT-4.1 / GPT-5 / o 系列使用 o200k_base，其余（Claude、Gemini 等无公开词表的模型）使用 cl100k_base 近似
+func encodingForModel(model string) string {
+	m := strings.ToLower(model)
+	switch {
+	case strings.HasPrefix(m, "gpt-4o"), strings.HasPrefix(m, "gpt-4.1"), strings.HasPrefix(m, "gpt-5"),
+		strings.HasPrefix(m, "o1"), strings.HasPrefix(m, "o3"), strings.HasPrefix(m, "o4"):
+		return encodingO200K
+	default:
+		return encodingCL100K
+	}
+}
+
+// encoderFor 获取（并缓存）指定编码的编码器，初始化失败返回 nil 且不再重试
+func encoderFor(name string) *tiktoken.Tiktoken {
+	// 使用内置词表，避免运行时从网络下载
+	loaderOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if enc, ok := encoders[name]; ok {
+		return enc
+	}
+	if failed[name] {
+		return nil
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		log.Warn("编码 %s 初始化失败，回退到字节估算: %v", name, err)
+		failed[name] = true
+		return nil
+	}
+	encoders[name] = enc
+	return enc
+}
+
+// estimate 简单估算：每 4 个字节约 1 个 token，非空文本至少为 1
+// 对中文和代码偏差较大，仅在编码器不可用时使用
+func estimate(text string) int {
+	tokens := len(text) / 4
+	if tokens < 1 {
+		tokens = 1
+	}
+	return tokens
+}
@@ -0,0 +1,221 @@
+package toolify
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Syntax 工具调用语法
+type Syntax string
+
+const (
+    // SyntaxVMTags 虚拟机标签: <vm_write path="">、<vm_exec> 等（默认）
+    SyntaxVMTags Syntax = "vm_tags"
+    // SyntaxFencedJSON ```json 代码块中的 {"name": ..., "input"/"arguments": ...}
+    SyntaxFencedJSON Syntax = "fenced_json"
+    // SyntaxFunctionCall OpenAI 风格的 {"function_call": {"name": ..., "arguments": "..."}}
+    SyntaxFunctionCall Syntax = "function_call"
+)
+
+// Parser 按启用的语法解析工具调用，不同语法解析出的调用统一为 ToolCall
+type Parser struct {
+    syntaxes map[Syntax]bool
+    // strip 彻底清理工具调用语法（见 StripSyntax）
+    strip bool
+}
+
+// NewParser 创建解析器，未指定语法时只启用 vm_tags
+func NewParser(syntaxes ...Syntax) *Parser {
+    p := &Parser{syntaxes: make(map[Syntax]bool)}
+    if len(syntaxes) == 0 {
+        syntaxes = []Syntax{SyntaxVMTags}
+    }
+    for _, s := range syntaxes {
+        p.syntaxes[s] = true
+    }
+    return p
+}
+
+// Enabled 是否启用了指定语法
+func (p *Parser) Enabled(s Syntax) bool {
+    return p.syntaxes[s]
+}
+
+// Parse 从响应中解析工具调用，返回工具调用和移除调用后的文本
+// 依次处理 vm 标签、fenced JSON、function_call，已被前一种语法消费的文本不会再被后面的语法匹配
+func (p *Parser) Parse(response string) ([]ToolCall, string) {
+    var toolCalls []ToolCall
+    cleanResponse := response
+
+    if p.syntaxes[SyntaxVMTags] {
+        toolCalls, cleanResponse = parseVMTags(cleanResponse, p.cut())
+    }
+    if p.syntaxes[SyntaxFencedJSON] {
+        var calls []ToolCall
+        calls, cleanResponse = parseFencedJSON(cleanResponse, p.cut())
+        toolCalls = append(toolCalls, calls...)
+    }
+    if p.syntaxes[SyntaxFunctionCall] {
+        var calls []ToolCall
+        calls, cleanResponse = parseFunctionCalls(cleanResponse, p.cut())
+        toolCalls = append(toolCalls, calls...)
+    }
+    if p.strip {
+        cleanResponse = stripMarkup(cleanResponse)
+    }
+
+    return toolCalls, strings.TrimSpace(cleanResponse)
+}
+
+// fencedJSONPattern 匹配 ```json ... ``` 代码块
+var fencedJSONPattern = regexp.MustCompile("(?s)```(?:json)?\\s*\\n(.*?)\\n?```")
+
+// functionCallPattern 匹配 function_call 对象的起始位置
+var functionCallPattern = regexp.MustCompile(`\{\s*"function_call"\s*:`)
+
+// jsonToolCall fenced JSON / function_call 中的工具调用
+type jsonToolCall struct {
+    Name         string          `json:"name"`
+    Input        json.RawMessage `json:"input"`
+    Arguments    json.RawMessage `json:"arguments"`
+    Parameters   json.RawMessage `json:"parameters"`
+    FunctionCall *jsonToolCall   `json:"function_call"`
+}
+
+// toToolCall 转换为 ToolCall，不是工具调用形状的对象返回 false
+func (j jsonToolCall) toToolCall(id string) (ToolCall, bool) {
+    if j.FunctionCall != nil {
+        return j.FunctionCall.toToolCall(id)
+    }
+    if j.Name == "" {
+        return ToolCall{}, false
+    }
+
+    raw := j.Input
+    if len(raw) == 0 {
+        raw = j.Arguments
+    }
+    if len(raw) == 0 {
+        raw = j.Parameters
+    }
+    if len(raw) == 0 {
+        return ToolCall{}, false
+    }
+    // 显式的 "input": null 视为空输入
+    if strings.TrimSpace(string(raw)) == "null" {
+        raw = json.RawMessage("{}")
+    }
+
+    // OpenAI 的 arguments 是 JSON 字符串，需要再解一层
+    var encoded string
+    if err := json.Unmarshal(raw, &encoded); err == nil {
+        raw = json.RawMessage(encoded)
+    }
+    var args map[string]interface{}
+    repaired, err := unmarshalLenient(string(raw), &args)
+    if err != nil {
+        return ToolCall{}, false
+    }
+    argsJSON, _ := json.Marshal(args)
+
+    return ToolCall{
+        ID:       id,
+        Type:     "function",
+        Function: ToolCallFunction{Name: j.Name, Arguments: string(argsJSON)},
+        Repaired: repaired,
+    }, true
+}
+
+// parseFencedJSON 解析 ```json 代码块中的工具调用（单个对象或对象数组）
+// 只有整个代码块都是工具调用时才会被消费，普通 JSON 示例原样保留
+// JSON 格式有误时先尝试宽松修复；修复失败的代码块原样保留在文本中，不会被丢弃
+// 被消费的代码块替换为 cut
+func parseFencedJSON(response, cut string) ([]ToolCall, string) {
+    var toolCalls []ToolCall
+    cleanResponse := response
+
+    for _, match := range fencedJSONPattern.FindAllStringSubmatch(response, -1) {
+        body := strings.TrimSpace(match[1])
+
+        var items []jsonToolCall
+        var repaired bool
+        var err error
+        if strings.HasPrefix(body, "[") {
+            repaired, err = unmarshalLenient(body, &items)
+        } else {
+            var item jsonToolCall
+            repaired, err = unmarshalLenient(body, &item)
+            items = []jsonToolCall{item}
+        }
+        if err != nil {
+            continue
+        }
+
+        var calls []ToolCall
+        for _, item := range items {
+            call, ok := item.toToolCall(fmt.Sprintf("j%d", len(toolCalls)+len(calls)))
+            if !ok {
+                calls = nil
+                break
+            }
+            call.Repaired = call.Repaired || repaired
+            calls = append(calls, call)
+        }
+        if len(calls) == 0 {
+            continue
+        }
+
+        toolCalls = append(toolCalls, calls...)
+        cleanResponse = strings.Replace(cleanResponse, match[0], cut, 1)
+    }
+
+    return toolCalls, cleanResponse
+}
+
+// parseFunctionCalls 解析文本中的 {"function_call": {...}} 对象，解析出的对象替换为 cut
+func parseFunctionCalls(response, cut string) ([]ToolCall, string) {
+    var toolCalls []ToolCall
+    var clean strings.Builder
+
+    rest := response
+    for {
+        loc := functionCallPattern.FindStringIndex(rest)
+        if loc == nil {
+            break
+        }
+        clean.WriteString(rest[:loc[0]])
+
+        // 用 Decoder 读出完整的 JSON 对象，得到其结束位置
+        dec := json.NewDecoder(strings.NewReader(rest[loc[0]:]))
+        var item jsonToolCall
+        var repaired bool
+        end := 0
+        if err := dec.Decode(&item); err == nil {
+            end = loc[0] + int(dec.InputOffset())
+        } else {
+            // JSON 格式有误：按括号匹配找到对象范围后尝试宽松修复，失败时原样保留在文本中
+            objectEnd, _ := jsonObjectEnd(rest[loc[0]:])
+            end = loc[0] + objectEnd
+            item = jsonToolCall{}
+            if repaired, err = unmarshalLenient(rest[loc[0]:end], &item); err != nil {
+                clean.WriteString(rest[loc[0]:loc[1]])
+                rest = rest[loc[1]:]
+                continue
+            }
+        }
+
+        if call, ok := item.toToolCall(fmt.Sprintf("fc%d", len(toolCalls))); ok {
+            call.Repaired = call.Repaired || repaired
+            toolCalls = append(toolCalls, call)
+            clean.WriteString(cut)
+        } else {
+            clean.WriteString(rest[loc[0]:end])
+        }
+        rest = rest[end:]
+    }
+    clean.WriteString(rest)
+
+    return toolCalls, clean.String()
+}
@@ -0,0 +1,172 @@
+package toolify
+
+import (
+    "encoding/json"
+    "strings"
+)
+
+// repairJSON 宽松修复模型输出中常见的 JSON 错误，修复后仍无法解析时返回 false
+// 处理：尾随逗号、未加引号的键、单引号字符串、字符串中的裸换行、Python 风格的 True/False/None、末尾缺失的括号
+func repairJSON(s string) (string, bool) {
+    var out strings.Builder
+    var closers []byte // 尚未闭合的括号对应的闭合符
+    var quote byte     // 当前字符串的引号（0 表示不在字符串中）
+
+    for i := 0; i < len(s); i++ {
+        ch := s[i]
+
+        if quote != 0 {
+            switch {
+            case ch == '\\' && i+1 < len(s):
+                // 单引号字符串中的 \' 在 JSON 中不需要转义
+                if quote == '\'' && s[i+1] == '\'' {
+                    out.WriteByte('\'')
+                } else {
+                    out.WriteByte(ch)
+                    out.WriteByte(s[i+1])
+                }
+                i++
+            case ch == quote:
+                out.WriteByte('"')
+                quote = 0
+            case ch == '"':
+                out.WriteString(`\"`)
+            case ch == '\n':
+                out.WriteString(`\n`)
+            case ch == '\r':
+                out.WriteString(`\r`)
+            case ch == '\t':
+                out.WriteString(`\t`)
+            default:
+                out.WriteByte(ch)
+            }
+            continue
+        }
+
+        switch {
+        case ch == '"' || ch == '\'':
+            quote = ch
+            out.WriteByte('"')
+        case ch == '{':
+            closers = append(closers, '}')
+            out.WriteByte(ch)
+        case ch == '[':
+            closers = append(closers, ']')
+            out.WriteByte(ch)
+        case ch == '}' || ch == ']':
+            if len(closers) == 0 || closers[len(closers)-1] != ch {
+                return "", false
+            }
+            closers = closers[:len(closers)-1]
+            out.WriteByte(ch)
+        case ch == ',':
+            // 尾随逗号：下一个非空白字符是闭合括号（或已到末尾）时丢弃
+            next := strings.TrimLeft(s[i+1:], " \t\r\n")
+            if next == "" || next[0] == '}' || next[0] == ']' {
+                continue
+            }
+            out.WriteByte(ch)
+        case ch == '-' || (ch >= '0' && ch <= '9'):
+            // 数字整体原样输出，避免指数部分的 e 被当作标识符
+            j := i + 1
+            for j < len(s) && strings.IndexByte("0123456789.eE+-", s[j]) >= 0 {
+                j++
+            }
+            out.WriteString(s[i:j])
+            i = j - 1
+        case isIdentStart(ch):
+            j := i + 1
+            for j < len(s) && isIdentPart(s[j]) {
+                j++
+            }
+            word := s[i:j]
+            if strings.HasPrefix(strings.TrimLeft(s[j:], " \t\r\n"), ":") {
+                out.WriteString(`"` + word + `"`)
+            } else if literal, ok := jsonLiterals[word]; ok {
+                out.WriteString(literal)
+            } else {
+                return "", false
+            }
+            i = j - 1
+        default:
+            out.WriteByte(ch)
+        }
+    }
+
+    // 输出在字符串或对象中途结束：补齐引号和括号
+    if quote != 0 {
+        out.WriteByte('"')
+    }
+    for i := len(closers) - 1; i >= 0; i-- {
+        out.WriteByte(closers[i])
+    }
+
+    repaired := out.String()
+    if !json.Valid([]byte(repaired)) {
+        return "", false
+    }
+    return repaired, true
+}
+
+// jsonLiterals 值位置上允许的裸标识符及其 JSON 形式
+var jsonLiterals = map[string]string{
+    "true":  "true",
+    "false": "false",
+    "null":  "null",
+    "True":  "true",
+    "False": "false",
+    "None":  "null",
+}
+
+func isIdentStart(ch byte) bool {
+    return ch == '_' || ch == '$' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdentPart(ch byte) bool {
+    return isIdentStart(ch) || (ch >= '0' && ch <= '9') || ch == '-'
+}
+
+// unmarshalLenient 解析 JSON，失败时先修复再解析；repaired 表示使用了修复后的 JSON
+func unmarshalLenient(data string, v interface{}) (repaired bool, err error) {
+    if err = json.Unmarshal([]byte(data), v); err == nil {
+        return false, nil
+    }
+    fixed, ok := repairJSON(data)
+    if !ok {
+        return false, err
+    }
+    if fixErr := json.Unmarshal([]byte(fixed), v); fixErr != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// jsonObjectEnd 返回 s 开头 JSON 对象（可能格式错误）的结束位置，支持单引号字符串
+// 对象未闭合时返回 len(s) 和 false
+func jsonObjectEnd(s string) (int, bool) {
+    depth := 0
+    var quote byte
+    for i := 0; i < len(s); i++ {
+        ch := s[i]
+        if quote != 0 {
+            if ch == '\\' {
+                i++
+            } else if ch == quote {
+                quote = 0
+            }
+            continue
+        }
+        switch ch {
+        case '"', '\'':
+            quote = ch
+        case '{', '[':
+            depth++
+        case '}', ']':
+            depth--
+            if depth == 0 {
+                return i + 1, true
+            }
+        }
+    }
+    return len(s), false
+}
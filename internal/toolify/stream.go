@@ -0,0 +1,207 @@
+package toolify
+
+import (
+    "strings"
+)
+
+// Segment 响应中按出现顺序切分出的一段：普通文本或一组工具调用
+type Segment struct {
+    // Text 普通文本（Calls 为空时有效）
+    Text string
+    // Calls 该段标记解析出的工具调用
+    Calls []ToolCall
+    // Partial 响应在 vm 标签中途结束，Text 为未闭合的标签原文（由 ParsePartialToolCall 处理）
+    Partial bool
+}
+
+// Stream 增量切分流式响应，使文本和工具调用按实际出现的顺序下发
+// 可能是工具调用起始的内容先缓存，直到标记完整后再解析；确定不是工具调用的文本立即返回
+type Stream struct {
+    parser  *Parser
+    pending string
+}
+
+// NewStream 创建增量切分器
+func (p *Parser) NewStream() *Stream {
+    return &Stream{parser: p}
+}
+
+// Segments 一次性切分完整响应
+func (p *Parser) Segments(response string) []Segment {
+    s := p.NewStream()
+    return append(s.Feed(response), s.Flush()...)
+}
+
+// fencedMarker fenced JSON 代码块的起止标记
+const fencedMarker = "```"
+
+// functionCallPrefix function_call 对象的起始（去除空白后）
+const functionCallPrefix = `{"function_call"`
+
+// maxFunctionCallPrefix 缓存疑似 function_call 起始的最大字节数
+const maxFunctionCallPrefix = 64
+
+// Feed 追加一段文本，返回已经可以确定的段
+func (s *Stream) Feed(text string) []Segment {
+    s.pending += text
+    var segments []Segment
+    for {
+        start, end := s.nextMarkup()
+        if start < 0 {
+            keep := s.holdback()
+            segments = appendText(segments, s.pending[:len(s.pending)-keep])
+            s.pending = s.pending[len(s.pending)-keep:]
+            return segments
+        }
+        // 开启 StripSyntax 时，直接包裹标记的代码块/行内代码一并作为标记处理
+        if s.parser.strip {
+            if ws := wrapperStart(s.pending[:start]); ws >= 0 {
+                closeEnd, more := -1, end < 0
+                if end >= 0 {
+                    closeEnd, more = wrapperEnd(s.pending[ws:start], s.pending[end:])
+                }
+                if more {
+                    // 标记或闭合包裹尚未完整，从包裹开始缓存
+                    segments = appendText(segments, s.pending[:ws])
+                    s.pending = s.pending[ws:]
+                    return segments
+                }
+                if closeEnd >= 0 {
+                    start, end = ws, end+closeEnd
+                }
+            }
+        }
+        segments = appendText(segments, s.pending[:start])
+        s.pending = s.pending[start:]
+        if end < 0 {
+            return segments
+        }
+        end -= start
+        segments = append(segments, s.markupSegments(s.pending[:end])...)
+        s.pending = s.pending[end:]
+    }
+}
+
+// Flush 响应结束时返回缓存的剩余内容
+// 未闭合的 vm 标签标记为 Partial；其余内容能解析出工具调用时返回调用，否则作为文本返回
+func (s *Stream) Flush() []Segment {
+    rest := s.pending
+    s.pending = ""
+    if rest == "" {
+        return nil
+    }
+    if calls, clean := s.parser.Parse(rest); len(calls) > 0 {
+        return appendText([]Segment{{Calls: calls}}, clean)
+    }
+    if s.parser.Enabled(SyntaxVMTags) && ParsePartialToolCall(rest) != nil {
+        return []Segment{{Text: rest, Partial: true}}
+    }
+    return appendText(nil, rest)
+}
+
+// nextMarkup 查找缓存中最早的工具调用标记，返回起止位置；没有标记时 start 为 -1，标记未闭合时 end 为 -1
+func (s *Stream) nextMarkup() (start, end int) {
+    start, end = -1, -1
+    consider := func(idx int, endOf func(rest string) int) {
+        if idx < 0 || (start >= 0 && idx >= start) {
+            return
+        }
+        start, end = idx, -1
+        if e := endOf(s.pending[idx:]); e >= 0 {
+            end = idx + e
+        }
+    }
+
+    if s.parser.Enabled(SyntaxVMTags) {
+        for _, tag := range vmOpenTags {
+            closeTag := vmCloseTags[tag]
+            consider(strings.Index(s.pending, tag), func(rest string) int {
+                if idx := strings.Index(rest, closeTag); idx >= 0 {
+                    return idx + len(closeTag)
+                }
+                return -1
+            })
+        }
+    }
+    if s.parser.Enabled(SyntaxFencedJSON) {
+        consider(strings.Index(s.pending, fencedMarker), func(rest string) int {
+            if idx := strings.Index(rest[len(fencedMarker):], fencedMarker); idx >= 0 {
+                return len(fencedMarker) + idx + len(fencedMarker)
+            }
+            return -1
+        })
+    }
+    if s.parser.Enabled(SyntaxFunctionCall) {
+        idx := -1
+        if loc := functionCallPattern.FindStringIndex(s.pending); loc != nil {
+            idx = loc[0]
+        }
+        consider(idx, func(rest string) int {
+            if e, ok := jsonObjectEnd(rest); ok {
+                return e
+            }
+            return -1
+        })
+    }
+    return start, end
+}
+
+// holdback 缓存末尾可能是标记开头的字节数，这部分等待后续文本再判断
+func (s *Stream) holdback() int {
+    var markers []string
+    if s.parser.Enabled(SyntaxVMTags) {
+        markers = append(markers, vmOpenTags...)
+    }
+    if s.parser.Enabled(SyntaxFencedJSON) {
+        markers = append(markers, fencedMarker)
+    }
+
+    keep := 0
+    for _, marker := range markers {
+        for k := min(len(marker)-1, len(s.pending)); k > keep; k-- {
+            if strings.HasSuffix(s.pending, marker[:k]) {
+                keep = k
+                break
+            }
+        }
+    }
+
+    if s.parser.Enabled(SyntaxFunctionCall) {
+        if idx := strings.LastIndexByte(s.pending, '{'); idx >= 0 {
+            tail := s.pending[idx:]
+            compact := strings.Join(strings.Fields(tail), "")
+            if len(tail) <= maxFunctionCallPrefix && strings.HasPrefix(functionCallPrefix, compact) {
+                keep = max(keep, len(tail))
+            }
+        }
+    }
+
+    // 开启 StripSyntax 时，末尾的代码块起始行或 ` 可能包裹着随后的工具调用，一并缓存
+    if s.parser.strip {
+        if ws := wrapperStart(s.pending[:len(s.pending)-keep]); ws >= 0 {
+            keep = len(s.pending) - ws
+        }
+    }
+    return keep
+}
+
+// markupSegments 解析一段完整的标记；解析不出工具调用时作为文本返回
+func (s *Stream) markupSegments(markup string) []Segment {
+    calls, clean := s.parser.Parse(markup)
+    if len(calls) == 0 {
+        return appendText(nil, markup)
+    }
+    return appendText([]Segment{{Calls: calls}}, clean)
+}
+
+// appendText 追加文本段，与前一个文本段合并，忽略空文本
+func appendText(segments []Segment, text string) []Segment {
+    if text == "" {
+        return segments
+    }
+    if n := len(segments); n > 0 && len(segments[n-1].Calls) == 0 && !segments[n-1].Partial {
+        segments[n-1].Text += text
+        return segments
+    }
+    return append(segments, Segment{Text: text})
+}
@@ -0,0 +1,156 @@
+package toolify
+
+import (
+    "strings"
+)
+
+// markupSentinel 开启 StripSyntax 时，解析出的工具调用标记先替换为该占位符，
+// 再由 stripMarkup 连同外层的代码块/行内代码包裹和留下的多余空白一起清理
+const markupSentinel = "\x00"
+
+// closingPunctuation 紧跟在被移除标记之后时，不在前面补空格的标点
+const closingPunctuation = ".,;:!?)]}，。；：！？）"
+
+// StripSyntax 设置是否彻底清理工具调用语法：除标记本身外，同时去掉直接包裹标记的 ``` 代码块或 ` 行内代码，
+// 以及标记位于段落中间或独占一行时留下的多余空格和空行，使返回给用户的文本不残留工具调用的痕迹
+func (p *Parser) StripSyntax(strip bool) *Parser {
+    p.strip = strip
+    return p
+}
+
+// cut 解析出工具调用后替换标记的内容
+func (p *Parser) cut() string {
+    if p.strip {
+        return markupSentinel
+    }
+    return ""
+}
+
+// stripMarkup 清理文本中的所有占位符
+func stripMarkup(text string) string {
+    for {
+        idx := strings.Index(text, markupSentinel)
+        if idx < 0 {
+            return text
+        }
+        left, right := text[:idx], text[idx+len(markupSentinel):]
+        // 同一代码块中的多个调用：合并只隔着空白的占位符
+        for {
+            trimmed := strings.TrimLeft(right, " \t\r\n")
+            if !strings.HasPrefix(trimmed, markupSentinel) {
+                break
+            }
+            right = trimmed[len(markupSentinel):]
+        }
+        text = joinAround(unwrapMarkup(left, right))
+    }
+}
+
+// unwrapMarkup 去掉直接包裹被移除标记的 ``` 代码块或 ` 行内代码，不是包裹时原样返回
+func unwrapMarkup(left, right string) (string, string) {
+    l := strings.TrimRight(left, " \t\r\n")
+    r := strings.TrimLeft(right, " \t\r\n")
+    if open := fenceOpenIndex(l); open >= 0 && strings.HasPrefix(r, fencedMarker) {
+        after := r[len(fencedMarker):]
+        if after == "" || after[0] == '\n' || after[0] == '\r' {
+            return l[:open], after
+        }
+    }
+    if strings.HasSuffix(l, "`") && strings.HasPrefix(r, "`") && !strings.HasSuffix(l, "``") && !strings.HasPrefix(r, "``") {
+        return l[:len(l)-1], r[1:]
+    }
+    return left, right
+}
+
+// fenceOpenIndex text 的最后一行是代码块起始行（```，可带语言名）时返回该行的起始位置，否则返回 -1
+func fenceOpenIndex(text string) int {
+    start := strings.LastIndexByte(text, '\n') + 1
+    line := strings.TrimLeft(text[start:], " \t")
+    if !strings.HasPrefix(line, fencedMarker) {
+        return -1
+    }
+    for _, r := range line[len(fencedMarker):] {
+        if !isLanguageRune(r) {
+            return -1
+        }
+    }
+    return start
+}
+
+// isLanguageRune 代码块语言名中允许的字符
+func isLanguageRune(r rune) bool {
+    return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_+-.#", r)
+}
+
+// joinAround 拼接被移除标记两侧的文本：
+// 标记独占一行时去掉留下的空行（相邻段落间最多保留一个空行），位于行中时两侧的空白合并为一个空格
+func joinAround(left, right string) string {
+    l := strings.TrimRight(left, " \t")
+    r := strings.TrimLeft(right, " \t")
+    if l == "" || r == "" {
+        return l + r
+    }
+
+    lineBreaksBefore := len(l) - len(strings.TrimRight(l, "\r\n"))
+    lineBreaksAfter := len(r) - len(strings.TrimLeft(r, "\r\n"))
+    switch {
+    case lineBreaksBefore > 0 && lineBreaksAfter > 0:
+        newlines := min(max(strings.Count(l[len(l)-lineBreaksBefore:], "\n"), strings.Count(r[:lineBreaksAfter], "\n")), 2)
+        return strings.TrimRight(l, "\r\n") + strings.Repeat("\n", newlines) + strings.TrimLeft(r, "\r\n")
+    case lineBreaksBefore > 0 || lineBreaksAfter > 0:
+        return l + r
+    }
+
+    // 行中：原本两侧有空白时保留一个空格（紧跟标点时不加）
+    first := []rune(r)[0]
+    if (l != left || r != right) && !strings.ContainsRune(closingPunctuation, first) {
+        return l + " " + r
+    }
+    return l + r
+}
+
+// wrapperStart text 末尾（忽略空白）是代码块起始行或行内代码的 ` 时返回其起始位置，否则返回 -1
+// 用于流式切分时判断紧接着的工具调用标记是否被包裹
+func wrapperStart(text string) int {
+    l := strings.TrimRight(text, " \t\r\n")
+    if open := fenceOpenIndex(l); open >= 0 {
+        return open
+    }
+    // 流式响应中尚未完整的代码块起始行
+    if start := strings.LastIndexByte(l, '\n') + 1; strings.TrimLeft(l[start:], " \t") == "``" {
+        return start
+    }
+    if strings.HasSuffix(l, "`") && !strings.HasSuffix(l, "``") {
+        return len(l) - 1
+    }
+    return -1
+}
+
+// wrapperEnd 判断 rest（紧跟在标记之后的文本）开头是否是与 opening 对应的闭合包裹
+// 返回闭合包裹结束的位置；不是闭合包裹时返回 -1；还需要更多文本才能判断时 more 为 true
+func wrapperEnd(opening, rest string) (end int, more bool) {
+    trimmed := strings.TrimLeft(rest, " \t\r\n")
+    skipped := len(rest) - len(trimmed)
+    closer := "`"
+    if strings.HasPrefix(opening, fencedMarker) {
+        closer = fencedMarker
+    }
+    if len(trimmed) <= len(closer) {
+        if !strings.HasPrefix(closer, trimmed) {
+            return -1, false
+        }
+        // ``` 之后需要看到换行或响应结束，` 之后需要确认不是 ``
+        return -1, true
+    }
+    if !strings.HasPrefix(trimmed, closer) {
+        return -1, false
+    }
+    next := trimmed[len(closer)]
+    if closer == fencedMarker && next != '\n' && next != '\r' {
+        return -1, false
+    }
+    if closer == "`" && next == '`' {
+        return -1, false
+    }
+    return skipped + len(closer), false
+}
@@ -0,0 +1,99 @@
+package toolify
+
+import (
+    "strings"
+    "testing"
+)
+
+// toolNames 返回工具调用的名称
+func toolNames(calls []ToolCall) []string {
+    names := make([]string, 0, len(calls))
+    for _, call := range calls {
+        names = append(names, call.Function.Name)
+    }
+    return names
+}
+
+func TestStripSyntax(t *testing.T) {
+    tests := []struct {
+        name      string
+        response  string
+        wantTools []string
+        wantText  string
+    }{
+        {
+            name:      "vm tag mid-paragraph",
+            response:  `Let me check the directory <vm_exec>ls -la</vm_exec> and then continue.`,
+            wantTools: []string{"Bash"},
+            wantText:  "Let me check the directory and then continue.",
+        },
+        {
+            name:      "vm tag before punctuation",
+            response:  "Running it now <vm_exec>make test</vm_exec>.",
+            wantTools: []string{"Bash"},
+            wantText:  "Running it now.",
+        },
+        {
+            name:      "vm tag in inline code",
+            response:  "I will run `<vm_exec>go vet ./...</vm_exec>` first.",
+            wantTools: []string{"Bash"},
+            wantText:  "I will run first.",
+        },
+        {
+            name:      "vm tag in code fence",
+            response:  "Writing the file:\n\n```\n<vm_write path=\"a.txt\">hello</vm_write>\n```\n\nDone.",
+            wantTools: []string{"Write"},
+            wantText:  "Writing the file:\n\nDone.",
+        },
+        {
+            name:      "fenced JSON mid-paragraph",
+            response:  "Looking it up.\n```json\n{\"name\": \"Search\", \"input\": {\"q\": \"go\"}}\n```\nBack shortly.",
+            wantTools: []string{"Search"},
+            wantText:  "Looking it up.\nBack shortly.",
+        },
+        {
+            name:      "multiple calls",
+            response:  "First <vm_exec>pwd</vm_exec> then\n\n<vm_write path=\"b.txt\">x</vm_write>\n\nand finally\n```json\n{\"name\": \"Search\", \"input\": {}}\n```\nall set.",
+            wantTools: []string{"Write", "Bash", "Search"},
+            wantText:  "First then\n\nand finally\nall set.",
+        },
+        {
+            name:      "adjacent calls in one fence",
+            response:  "Both:\n```\n<vm_exec>pwd</vm_exec>\n<vm_exec>ls</vm_exec>\n```\nOK.",
+            wantTools: []string{"Bash", "Bash"},
+            wantText:  "Both:\nOK.",
+        },
+        {
+            name:      "only calls",
+            response:  "  <vm_exec>pwd</vm_exec>\n\n<vm_exec>ls</vm_exec>  ",
+            wantTools: []string{"Bash", "Bash"},
+            wantText:  "",
+        },
+    }
+    parser := NewParser(SyntaxVMTags, SyntaxFencedJSON).StripSyntax(true)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            calls, text := parser.Parse(tt.response)
+            if got := toolNames(calls); strings.Join(got, ",") != strings.Join(tt.wantTools, ",") {
+                t.Errorf("tools = %v, want %v", got, tt.wantTools)
+            }
+            if text != tt.wantText {
+                t.Errorf("text = %q, want %q", text, tt.wantText)
+            }
+            if strings.Contains(text, markupSentinel) || strings.Contains(text, "```") || strings.Contains(text, "<vm_") {
+                t.Errorf("text %q still contains tool-call syntax", text)
+            }
+        })
+    }
+}
+
+func TestStripSyntaxKeepsUnrelatedCode(t *testing.T) {
+    response := "Use `go test` to run it:\n```go\nfmt.Println(\"hi\")\n```\n<vm_exec>go test ./...</vm_exec>"
+    calls, text := NewParser().StripSyntax(true).Parse(response)
+    if len(calls) != 1 {
+        t.Fatalf("got %d calls, want 1", len(calls))
+    }
+    if want := "Use `go test` to run it:\n```go\nfmt.Println(\"hi\")\n```"; text != want {
+        t.Errorf("text = %q, want %q", text, want)
+    }
+}
@@ -51,11 +51,40 @@ func (t ToolDefinition) GetParameters() map[string]interface{} {
     return t.Function.Parameters
 }
 
+// ToolChoice 工具选择 (Anthropic 格式)
+type ToolChoice struct {
+    Type string `json:"type"`           // auto / any / tool / none
+    Name string `json:"name,omitempty"` // type 为 tool 时指定的工具名
+}
+
+// 工具选择类型
+const (
+    ToolChoiceAuto = "auto"
+    ToolChoiceAny  = "any"
+    ToolChoiceTool = "tool"
+    ToolChoiceNone = "none"
+)
+
+// IsNone 是否禁止使用工具
+func (c *ToolChoice) IsNone() bool {
+    return c != nil && c.Type == ToolChoiceNone
+}
+
+// toolTags 工具名对应的虚拟机标签
+var toolTags = map[string]string{
+    "Write":     "<vm_write>",
+    "Bash":      "<vm_exec>",
+    "WebSearch": "<vm_search>",
+    "WebFetch":  "<vm_fetch>",
+}
+
 // ToolCall 解析后的工具调用
 type ToolCall struct {
     ID       string           `json:"id"`
     Type     string           `json:"type"`
     Function ToolCallFunction `json:"function"`
+    // Repaired 模型输出的 JSON 格式有误，经宽松修复后才解析成功（便于记录日志）
+    Repaired bool `json:"-"`
 }
 
 // ToolCallFunction 工具调用函数
@@ -113,6 +142,24 @@ Fetch URL: <vm_fetch>url</vm_fetch>
 `
 }
 
+// ToolChoiceInstruction 生成 tool_choice 对应的提示，auto 或未设置时返回空字符串
+func ToolChoiceInstruction(choice *ToolChoice) string {
+    if choice == nil {
+        return ""
+    }
+    switch choice.Type {
+    case ToolChoiceAny:
+        return "You must perform at least one of the actions above in your response."
+    case ToolChoiceTool:
+        if tag, ok := toolTags[choice.Name]; ok {
+            return fmt.Sprintf("You must use %s in your response.", tag)
+        }
+        return fmt.Sprintf("You must use the %s tool in your response.", choice.Name)
+    default:
+        return ""
+    }
+}
+
 // 预编译正则表达式提升性能
 var (
     vmWritePattern  = regexp.MustCompile(`(?s)<vm_write\s+path="([^"]+)">(.*?)</vm_write>`)
@@ -123,6 +170,12 @@ var (
 
 // ParseToolCalls 从响应中解析工具调用
 func ParseToolCalls(response string) ([]ToolCall, string) {
+    toolCalls, cleanResponse := parseVMTags(response, "")
+    return toolCalls, strings.TrimSpace(cleanResponse)
+}
+
+// parseVMTags 解析 vm 标签形式的工具调用，解析出的标签替换为 cut
+func parseVMTags(response, cut string) ([]ToolCall, string) {
     var toolCalls []ToolCall
     cleanResponse := response
 
@@ -135,7 +188,7 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
                 Type:     "function",
                 Function: ToolCallFunction{Name: "Write", Arguments: string(args)},
             })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
+            cleanResponse = strings.Replace(cleanResponse, match[0], cut, 1)
         }
     }
 
@@ -148,7 +201,7 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
                 Type:     "function",
                 Function: ToolCallFunction{Name: "Bash", Arguments: string(args)},
             })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
+            cleanResponse = strings.Replace(cleanResponse, match[0], cut, 1)
         }
     }
 
@@ -161,7 +214,7 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
                 Type:     "function",
                 Function: ToolCallFunction{Name: "WebSearch", Arguments: string(args)},
             })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
+            cleanResponse = strings.Replace(cleanResponse, match[0], cut, 1)
         }
     }
 
@@ -174,11 +227,68 @@ func ParseToolCalls(response string) ([]ToolCall, string) {
                 Type:     "function",
                 Function: ToolCallFunction{Name: "WebFetch", Arguments: string(args)},
             })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
+            cleanResponse = strings.Replace(cleanResponse, match[0], cut, 1)
         }
     }
 
-    return toolCalls, strings.TrimSpace(cleanResponse)
+    return toolCalls, cleanResponse
+}
+
+// 未闭合工具标签的起始位置（用于截断恢复）
+var vmOpenTags = []string{"<vm_write", "<vm_exec>", "<vm_search>", "<vm_fetch>"}
+
+// vmCloseTags 起始标签对应的闭合标签
+var vmCloseTags = map[string]string{
+    "<vm_write":   "</vm_write>",
+    "<vm_exec>":   "</vm_exec>",
+    "<vm_search>": "</vm_search>",
+    "<vm_fetch>":  "</vm_fetch>",
+}
+
+// vmWriteOpenPattern 匹配完整的 vm_write 起始标签
+var vmWriteOpenPattern = regexp.MustCompile(`^<vm_write\s+path="([^"]+)">`)
+
+// ParsePartialToolCall 解析响应末尾未闭合的工具调用（流被截断时）
+// 返回已收到部分构成的工具调用；没有未闭合的调用或起始标签本身不完整时返回 nil
+func ParsePartialToolCall(response string) *ToolCall {
+    start, tag := -1, ""
+    for _, t := range vmOpenTags {
+        if idx := strings.LastIndex(response, t); idx > start {
+            start, tag = idx, t
+        }
+    }
+    if start < 0 {
+        return nil
+    }
+
+    rest := response[start:]
+    if strings.Contains(rest, vmCloseTags[tag]) {
+        return nil
+    }
+
+    var name string
+    var args map[string]string
+    switch tag {
+    case "<vm_write":
+        open := vmWriteOpenPattern.FindStringSubmatch(rest)
+        if open == nil {
+            return nil
+        }
+        name, args = "Write", map[string]string{"file_path": open[1], "content": rest[len(open[0]):]}
+    case "<vm_exec>":
+        name, args = "Bash", map[string]string{"command": strings.TrimSpace(rest[len(tag):])}
+    case "<vm_search>":
+        name, args = "WebSearch", map[string]string{"query": strings.TrimSpace(rest[len(tag):])}
+    case "<vm_fetch>":
+        name, args = "WebFetch", map[string]string{"url": strings.TrimSpace(rest[len(tag):])}
+    }
+
+    argsJSON, _ := json.Marshal(args)
+    return &ToolCall{
+        ID:       "partial",
+        Type:     "function",
+        Function: ToolCallFunction{Name: name, Arguments: string(argsJSON)},
+    }
 }
 
 // HasToolCalls 检查响应是否包含工具调用